@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"go.yym.plus/zeus/pkg/cache/redis"
+	"go.yym.plus/zeus/pkg/conf"
+	"go.yym.plus/zeus/pkg/conf/schema"
+	"go.yym.plus/zeus/pkg/db/sql"
+	"go.yym.plus/zeus/pkg/http"
+	"go.yym.plus/zeus/pkg/log"
+	"go.yym.plus/zeus/pkg/pubsub"
+)
+
+// moduleSchemas are the config schemas of the modules by name.
+var moduleSchemas = map[string]interface{}{
+	"db":     sql.EngineSchema,
+	"log":    log.ConfigSchema,
+	"http":   http.ConfigSchema,
+	"redis":  redis.ConfigSchema,
+	"pubsub": pubsub.ConfigSchema,
+}
+
+var confFlags struct {
+	keyFile string
+	format  string
+	schemas []string
+}
+
+var confCmd = &cobra.Command{
+	Use:   "conf",
+	Short: "configuration tools",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return registerSchemas(confFlags.schemas)
+	},
+}
+
+var confKeygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "generate an AES key file for encrypted config values",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := os.Stat(confFlags.keyFile); err == nil {
+			return fmt.Errorf("key file %s exists", confFlags.keyFile)
+		}
+		key, err := conf.GenerateSecretKey()
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(confFlags.keyFile, []byte(key+"\n"), 0600)
+	},
+}
+
+var confEncryptCmd = &cobra.Command{
+	Use:   "encrypt [VALUE]",
+	Short: "encrypt a value as ENC(...), reads stdin without VALUE",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := conf.LoadSecretKey(confFlags.keyFile)
+		if err != nil {
+			return err
+		}
+		value, err := argOrStdin(args)
+		if err != nil {
+			return err
+		}
+		encrypted, err := conf.Encrypt(key, value)
+		if err != nil {
+			return err
+		}
+		fmt.Println(encrypted)
+		return nil
+	},
+}
+
+var confDecryptCmd = &cobra.Command{
+	Use:   "decrypt [ENC(...)]",
+	Short: "decrypt an ENC(...) value, reads stdin without argument",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := conf.LoadSecretKey(confFlags.keyFile)
+		if err != nil {
+			return err
+		}
+		value, err := argOrStdin(args)
+		if err != nil {
+			return err
+		}
+		decrypted, err := conf.Decrypt(key, value)
+		if err != nil {
+			return err
+		}
+		fmt.Println(decrypted)
+		return nil
+	},
+}
+
+var confReferenceCmd = &cobra.Command{
+	Use:   "reference",
+	Short: "print the registered module configs with defaults, as yaml or json-schema",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var data []byte
+		var err error
+		switch confFlags.format {
+		case "yaml":
+			data, err = schema.Reference()
+		case "json-schema":
+			data, err = schema.JSONSchema()
+		default:
+			return fmt.Errorf("unknown format %s", confFlags.format)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	},
+}
+
+func init() {
+	confCmd.PersistentFlags().StringArrayVar(&confFlags.schemas, "schema", nil,
+		"KEY=MODULE registers the config of module db, log, http, redis or pubsub under KEY, "+
+			"repeatable, defaults to every module under its name")
+	confReferenceCmd.Flags().StringVar(&confFlags.format, "format", "yaml", "output format, yaml or json-schema")
+	for _, cmd := range []*cobra.Command{confKeygenCmd, confEncryptCmd, confDecryptCmd} {
+		cmd.Flags().StringVar(&confFlags.keyFile, "key-file", os.Getenv(conf.SecretKeyFileEnv), "AES key file, defaults to $"+conf.SecretKeyFileEnv)
+	}
+	confCmd.AddCommand(confKeygenCmd, confEncryptCmd, confDecryptCmd, confReferenceCmd)
+	rootCmd.AddCommand(confCmd)
+}
+
+// argOrStdin returns the only argument, or the first line of stdin so secrets
+// stay out of the shell history.
+func argOrStdin(args []string) (string, error) {
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("read value from stdin: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// registerSchemas registers the module configs of KEY=MODULE specs, or every
+// module under its name without specs.
+func registerSchemas(specs []string) error {
+	if len(specs) == 0 {
+		for name, prototype := range moduleSchemas {
+			schema.Register(name, prototype)
+		}
+		return nil
+	}
+	keys := map[string]bool{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("schema %q invalid, expect KEY=MODULE", spec)
+		}
+		prototype, ok := moduleSchemas[parts[1]]
+		if !ok {
+			return fmt.Errorf("schema module %s unknown", parts[1])
+		}
+		key := strings.ToLower(parts[0])
+		if keys[key] {
+			return fmt.Errorf("schema key %s given twice", parts[0])
+		}
+		keys[key] = true
+		schema.Register(key, prototype)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"go.yym.plus/zeus/pkg/conf"
+	"go.yym.plus/zeus/pkg/conf/schema"
+)
+
+const confURIEnv = "ZEUS_CONF_URI"
+
+var publishFlags struct {
+	uri          string
+	dataID       string
+	contentType  string
+	yes          bool
+	skipValidate bool
+	to           string
+	limit        int
+}
+
+var confValidateCmd = &cobra.Command{
+	Use:   "validate FILE",
+	Short: "validate a config file against the registered module config schemas",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := validateFile(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println("ok")
+		return nil
+	},
+}
+
+var confDiffCmd = &cobra.Command{
+	Use:   "diff FILE",
+	Short: "show the changes of a local config file against the nacos dataID",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		local, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		backend, err := newPublishBackend()
+		if err != nil {
+			return err
+		}
+		remote, err := backend.Get(publishFlags.dataID)
+		if err != nil {
+			return err
+		}
+		changes, err := diffContent(remote, local, contentTypeOf(args[0]))
+		if err != nil {
+			return err
+		}
+		printChanges(changes)
+		return nil
+	},
+}
+
+var confPushCmd = &cobra.Command{
+	Use:   "push FILE",
+	Short: "validate a config file, show its diff and publish it to the nacos dataID",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		local, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		if !publishFlags.skipValidate {
+			err = validateFile(args[0])
+			if err != nil {
+				return err
+			}
+		}
+		backend, err := newPublishBackend()
+		if err != nil {
+			return err
+		}
+		remote, err := backend.Get(publishFlags.dataID)
+		if err != nil {
+			return err
+		}
+		return publish(backend, remote, local, contentTypeOf(args[0]))
+	},
+}
+
+var confRollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "publish the previous version of the nacos dataID, or the revision of --to",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		backend, err := newPublishBackend()
+		if err != nil {
+			return err
+		}
+		id := publishFlags.to
+		if id == "" {
+			revisions, err := backend.History(publishFlags.dataID, 1)
+			if err != nil {
+				return err
+			}
+			if len(revisions) == 0 {
+				return fmt.Errorf("no previous version in nacos history")
+			}
+			id = revisions[0].ID
+		}
+		revision, err := backend.Revision(publishFlags.dataID, id)
+		if err != nil {
+			return err
+		}
+		contentType := contentTypeOf(publishFlags.dataID)
+		if !publishFlags.skipValidate {
+			// the schemas may have changed since the revision was published
+			err = validateContent([]byte(revision.Content), contentType)
+			if err != nil {
+				return fmt.Errorf("revision %s invalid: %v", revision.ID, err)
+			}
+		}
+		remote, err := backend.Get(publishFlags.dataID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("rollback to revision %s of %s\n", revision.ID, revision.Modified.Format(time.RFC3339))
+		return publish(backend, remote, []byte(revision.Content), contentType)
+	},
+}
+
+var confHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "list the nacos history of the dataID, newest first",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		backend, err := newPublishBackend()
+		if err != nil {
+			return err
+		}
+		revisions, err := backend.History(publishFlags.dataID, publishFlags.limit)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tOP\tMODIFIED\tUSER\tMD5")
+		for _, r := range revisions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.ID, r.OpType, r.Modified.Format(time.RFC3339), r.SrcUser, r.MD5)
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{confDiffCmd, confPushCmd, confRollbackCmd, confHistoryCmd} {
+		cmd.Flags().StringVar(&publishFlags.uri, "uri", os.Getenv(confURIEnv), "nacos uri, defaults to $"+confURIEnv)
+		cmd.Flags().StringVar(&publishFlags.dataID, "data-id", "", "dataID, defaults to the first dataID of the uri")
+	}
+	for _, cmd := range []*cobra.Command{confDiffCmd, confPushCmd, confRollbackCmd} {
+		cmd.Flags().StringVar(&publishFlags.contentType, "type", "", "config content type, defaults to the file or dataID extension, then yaml")
+	}
+	for _, cmd := range []*cobra.Command{confPushCmd, confRollbackCmd} {
+		cmd.Flags().BoolVarP(&publishFlags.yes, "yes", "y", false, "publish without confirmation")
+		cmd.Flags().BoolVar(&publishFlags.skipValidate, "skip-validate", false, "publish without schema validation")
+	}
+	confRollbackCmd.Flags().StringVar(&publishFlags.to, "to", "", "revision id to roll back to, see history")
+	confHistoryCmd.Flags().IntVar(&publishFlags.limit, "limit", 10, "number of revisions")
+	confCmd.AddCommand(confValidateCmd, confDiffCmd, confPushCmd, confRollbackCmd, confHistoryCmd)
+}
+
+func newPublishBackend() (*conf.NacosBackend, error) {
+	if publishFlags.uri == "" {
+		return nil, fmt.Errorf("nacos uri required, use --uri or $%s", confURIEnv)
+	}
+	backend, err := conf.NewNacosBackend([]string{publishFlags.uri})
+	if err != nil {
+		return nil, err
+	}
+	if publishFlags.dataID == "" {
+		publishFlags.dataID = backend.DataIDs()[0]
+	}
+	return backend, nil
+}
+
+func validateFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return validateContent(data, contentTypeOf(file))
+}
+
+// validateContent validates config content against the registered schemas.
+func validateContent(data []byte, contentType string) error {
+	v := viper.New()
+	v.SetConfigType(contentType)
+	err := v.ReadConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return schema.Validate(v)
+}
+
+// contentTypeOf returns the --type flag, or the extension of name, or yaml.
+func contentTypeOf(name string) string {
+	if publishFlags.contentType != "" {
+		return publishFlags.contentType
+	}
+	if ext := strings.TrimPrefix(filepath.Ext(name), "."); ext != "" {
+		return ext
+	}
+	return "yaml"
+}
+
+func diffContent(old, new []byte, contentType string) ([]*conf.Change, error) {
+	oldSettings, err := conf.ParseSettings(old, contentType)
+	if err != nil {
+		return nil, err
+	}
+	newSettings, err := conf.ParseSettings(new, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return conf.Diff(oldSettings, newSettings), nil
+}
+
+func printChanges(changes []*conf.Change) {
+	if len(changes) == 0 {
+		fmt.Println("no changes")
+		return
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+}
+
+// publish shows the diff from remote to content and publishes content after
+// confirmation.
+func publish(backend *conf.NacosBackend, remote, content []byte, contentType string) error {
+	if string(remote) == string(content) {
+		fmt.Println("already up to date")
+		return nil
+	}
+	changes, err := diffContent(remote, content, contentType)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Println("no changes besides formatting")
+	} else {
+		printChanges(changes)
+	}
+	if !publishFlags.yes && !confirm(fmt.Sprintf("publish %s?", publishFlags.dataID)) {
+		return fmt.Errorf("aborted")
+	}
+	err = backend.Set(publishFlags.dataID, content)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("published %s\n", publishFlags.dataID)
+	return nil
+}
+
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
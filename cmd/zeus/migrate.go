@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"go.yym.plus/zeus/pkg/db/migrate"
+	"go.yym.plus/zeus/pkg/db/sql"
+)
+
+const dbURIEnv = "ZEUS_DB_URI"
+
+var migrateFlags struct {
+	dbType      string
+	uri         string
+	dir         string
+	lockTimeout time.Duration
+	staleLock   time.Duration
+	to          int64
+	steps       int
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "apply .sql schema migrations named like 0001_create_users.up.sql",
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "apply pending migrations",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withMigrator(func(ctx context.Context, m *migrate.Migrator) error {
+			applied, err := m.UpTo(ctx, migrateFlags.to)
+			printMigrations("applied", applied)
+			return err
+		})
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "roll back the last applied migrations",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withMigrator(func(ctx context.Context, m *migrate.Migrator) error {
+			reverted, err := m.Down(ctx, migrateFlags.steps)
+			printMigrations("reverted", reverted)
+			return err
+		})
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show applied and pending migrations",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withMigrator(func(ctx context.Context, m *migrate.Migrator) error {
+			statuses, err := m.Status(ctx)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+			for _, s := range statuses {
+				state, appliedAt := "pending", ""
+				if s.AppliedAt != nil {
+					state, appliedAt = "applied", s.AppliedAt.Format(time.RFC3339)
+				}
+				if s.Modified {
+					state = "modified"
+				}
+				if s.Missing {
+					state = "missing"
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.Version, s.Name, state, appliedAt)
+			}
+			return w.Flush()
+		})
+	},
+}
+
+var migrateUnlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "release the lock left by a crashed migration",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withMigrator(func(ctx context.Context, m *migrate.Migrator) error {
+			return m.Unlock(ctx)
+		})
+	},
+}
+
+func init() {
+	migrateCmd.PersistentFlags().StringVar(&migrateFlags.dbType, "type", "mysql", "database type: mysql, postgres, mssql or sqlite3")
+	migrateCmd.PersistentFlags().StringVar(&migrateFlags.uri, "uri", os.Getenv(dbURIEnv), "database uri, defaults to $"+dbURIEnv)
+	migrateCmd.PersistentFlags().StringVar(&migrateFlags.dir, "dir", "migrations", "migrations directory")
+	migrateCmd.PersistentFlags().DurationVar(&migrateFlags.lockTimeout, "lock-timeout", time.Minute, "wait for other migrators up to")
+	migrateCmd.PersistentFlags().DurationVar(&migrateFlags.staleLock, "stale-lock", 10*time.Minute, "take over a lock not refreshed for, 0 to never")
+	migrateUpCmd.Flags().Int64Var(&migrateFlags.to, "to", 0, "apply up to the version, defaults to all")
+	migrateDownCmd.Flags().IntVar(&migrateFlags.steps, "steps", 1, "number of migrations to roll back")
+
+	migrateCmd.AddCommand(migrateUpCmd, migrateDownCmd, migrateStatusCmd, migrateUnlockCmd)
+	rootCmd.AddCommand(migrateCmd)
+}
+
+func withMigrator(f func(ctx context.Context, m *migrate.Migrator) error) error {
+	if migrateFlags.uri == "" {
+		return fmt.Errorf("database uri required, use --uri or $%s", dbURIEnv)
+	}
+	engine, err := sql.NewEngine(&sql.EngineConfig{
+		Type:     migrateFlags.dbType,
+		Uri:      migrateFlags.uri,
+		LogLevel: "off",
+	})
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+	m := migrate.New(engine, migrate.WithLockTimeout(migrateFlags.lockTimeout), migrate.WithStaleLock(migrateFlags.staleLock))
+	err = m.AddSQL(http.Dir(migrateFlags.dir), "/")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return f(ctx, m)
+}
+
+func printMigrations(action string, migrations []*migrate.Migration) {
+	for _, m := range migrations {
+		fmt.Printf("%s %d %s\n", action, m.Version, m.Name)
+	}
+	fmt.Printf("%s %d migrations\n", action, len(migrations))
+}
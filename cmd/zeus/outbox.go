@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/spf13/cobra"
+
+	"go.yym.plus/zeus/pkg/pubsub"
+)
+
+var outboxFlags struct {
+	db      string
+	topic   string
+	payload bool
+	file    string
+}
+
+var outboxCmd = &cobra.Command{
+	Use:   "outbox",
+	Short: "inspect and repair pending AsyncPub messages in a badger db, the owning service must be stopped",
+}
+
+var outboxListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list pending pushes",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withOutbox(func(outbox *pubsub.Outbox) error {
+			items, err := outbox.List(outboxFlags.topic)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			header := "SEQ\tTOPIC\tUUID\tAGE"
+			if outboxFlags.payload {
+				header += "\tPAYLOAD"
+			}
+			fmt.Fprintln(w, header)
+			for _, item := range items {
+				line := fmt.Sprintf("%d\t%s\t%s\t%s", item.Seq, item.Topic, item.UUID, item.Age().Truncate(time.Second))
+				if outboxFlags.payload {
+					line += "\t" + string(item.Payload)
+				}
+				fmt.Fprintln(w, line)
+			}
+			return w.Flush()
+		})
+	},
+}
+
+var outboxPurgeCmd = &cobra.Command{
+	Use:   "purge SEQ...",
+	Short: "delete pending pushes",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withOutbox(func(outbox *pubsub.Outbox) error {
+			seqs, err := parseSeqs(args)
+			if err != nil {
+				return err
+			}
+			items, err := outbox.Purge(seqs...)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("purged %d of %d\n", len(items), len(seqs))
+			return nil
+		})
+	},
+}
+
+var outboxRequeueCmd = &cobra.Command{
+	Use:   "requeue SEQ...",
+	Short: "move pending pushes to the tail of the outbox",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withOutbox(func(outbox *pubsub.Outbox) error {
+			seqs, err := parseSeqs(args)
+			if err != nil {
+				return err
+			}
+			items, err := outbox.Requeue(seqs...)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("requeued %d of %d\n", len(items), len(seqs))
+			return nil
+		})
+	},
+}
+
+var outboxExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export pending pushes as json lines",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withOutbox(func(outbox *pubsub.Outbox) error {
+			var w io.Writer = os.Stdout
+			if outboxFlags.file != "" && outboxFlags.file != "-" {
+				f, err := os.Create(outboxFlags.file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				w = f
+			}
+			n, err := outbox.Export(w, outboxFlags.topic)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "exported %d\n", n)
+			return nil
+		})
+	},
+}
+
+var outboxImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "import pending pushes from json lines",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withOutbox(func(outbox *pubsub.Outbox) error {
+			var r io.Reader = os.Stdin
+			if outboxFlags.file != "" && outboxFlags.file != "-" {
+				f, err := os.Open(outboxFlags.file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			items, err := outbox.Import(r)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("imported %d\n", len(items))
+			return nil
+		})
+	},
+}
+
+func init() {
+	outboxCmd.PersistentFlags().StringVar(&outboxFlags.db, "db", "", "badger db directory")
+	outboxCmd.MarkPersistentFlagRequired("db")
+	outboxListCmd.Flags().StringVar(&outboxFlags.topic, "topic", "", "only the topic")
+	outboxListCmd.Flags().BoolVar(&outboxFlags.payload, "payload", false, "show payload")
+	outboxExportCmd.Flags().StringVar(&outboxFlags.topic, "topic", "", "only the topic")
+	outboxExportCmd.Flags().StringVarP(&outboxFlags.file, "file", "f", "-", "output file")
+	outboxImportCmd.Flags().StringVarP(&outboxFlags.file, "file", "f", "-", "input file")
+
+	outboxCmd.AddCommand(outboxListCmd, outboxPurgeCmd, outboxRequeueCmd, outboxExportCmd, outboxImportCmd)
+	rootCmd.AddCommand(outboxCmd)
+}
+
+func withOutbox(f func(outbox *pubsub.Outbox) error) error {
+	opt := badger.DefaultOptions(outboxFlags.db)
+	opt.Truncate = true
+	opt.Logger = nil
+	db, err := badger.Open(opt)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	outbox, err := pubsub.NewOutbox(db)
+	if err != nil {
+		return err
+	}
+	defer outbox.Close()
+	return f(outbox)
+}
+
+func parseSeqs(args []string) ([]uint64, error) {
+	seqs := make([]uint64, 0, len(args))
+	for _, arg := range args {
+		seq, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("seq %s invalid", arg)
+		}
+		seqs = append(seqs, seq)
+	}
+	return seqs, nil
+}
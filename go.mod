@@ -4,42 +4,52 @@ go 1.14
 
 require (
 	github.com/DataDog/zstd v1.4.5 // indirect
-	github.com/ThreeDotsLabs/watermill-googlecloud v1.0.6 // indirect
+	github.com/ThreeDotsLabs/watermill v1.2.0-rc.3
+	github.com/ThreeDotsLabs/watermill-googlecloud v1.0.6
 	github.com/bketelsen/crypt v0.0.3
 	github.com/creasty/defaults v1.3.0
-	github.com/dgraph-io/badger/v2 v2.2007.2 // indirect
+	github.com/denisenkom/go-mssqldb v0.0.0-20200428022330-06a60b6afbbc
+	github.com/dgraph-io/badger/v2 v2.2007.2
 	github.com/dgraph-io/ristretto v0.0.3 // indirect
 	github.com/dgryski/go-farm v0.0.0-20200201041132-a6ae2369ad13 // indirect
 	github.com/emirpasic/gods v1.12.0
-	github.com/fsnotify/fsnotify v1.4.9 // indirect
-	github.com/gin-gonic/gin v1.6.2 // indirect
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/gin-gonic/gin v1.6.2
 	github.com/go-playground/validator/v10 v10.2.0
-	github.com/go-redis/redis/v8 v8.3.0 // indirect
+	github.com/go-redis/redis/v8 v8.3.0
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/golang/snappy v0.0.2 // indirect
 	github.com/goware/urlx v0.3.1
-	github.com/iancoleman/strcase v0.0.0-20191112232945-16388991a334 // indirect
+	github.com/iancoleman/strcase v0.0.0-20191112232945-16388991a334
 	github.com/imroc/req v0.3.0
 	github.com/karrick/tparse v2.4.2+incompatible // indirect
 	github.com/lestrrat-go/file-rotatelogs v2.3.0+incompatible
 	github.com/lestrrat-go/strftime v1.0.4 // indirect
+	github.com/lib/pq v1.7.0
 	github.com/magiconair/properties v1.8.4 // indirect
+	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/mitchellh/mapstructure v1.3.3
 	github.com/nacos-group/nacos-sdk-go v1.0.1
 	github.com/pelletier/go-toml v1.8.1 // indirect
 	github.com/pkg/errors v0.9.1
-	github.com/segmentio/ksuid v1.0.3 // indirect
+	github.com/prometheus/client_golang v1.8.0
+	github.com/segmentio/ksuid v1.0.3
 	github.com/spf13/afero v1.4.1 // indirect
 	github.com/spf13/cast v1.3.1
+	github.com/spf13/cobra v1.1.1
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.1
 	github.com/swaggo/gin-swagger v1.2.0 // indirect
 	github.com/tendermint/tm-db v0.6.2 // indirect
-	github.com/xhit/go-str2duration v1.2.0 // indirect
+	github.com/xeipuuv/gojsonschema v1.2.0
+	github.com/xhit/go-str2duration v1.2.0
 	go.mongodb.org/mongo-driver v1.4.2 // indirect
 	go.uber.org/zap v1.15.0
-	google.golang.org/api v0.45.0 // indirect
+	google.golang.org/api v0.45.0
 	gopkg.in/ini.v1 v1.62.0 // indirect
-	xorm.io/core v0.7.3 // indirect
-	xorm.io/xorm v1.0.5 // indirect
+	gopkg.in/yaml.v2 v2.3.0
+	xorm.io/builder v0.3.7
+	xorm.io/core v0.7.3
+	xorm.io/xorm v1.0.5
 )
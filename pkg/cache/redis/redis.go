@@ -26,6 +26,10 @@ type Config struct {
 	IdleCheckFrequency time.Duration
 }
 
+// ConfigSchema is the config schema of a client, for the application to
+// register under the key it chooses, like schema.Register("redis", redis.ConfigSchema).
+var ConfigSchema = Config{}
+
 //创建redis连接
 func NewRedis(conf *Config) (*redis.Client, error) {
 	client := redis.NewClient(&redis.Options{
@@ -0,0 +1,151 @@
+package conf
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"go.yym.plus/zeus/pkg/log"
+	"go.yym.plus/zeus/pkg/utils/structs"
+)
+
+// Binding decodes a viper into a typed config struct, keeps the last valid
+// snapshot and notifies subscribers of the key paths that changed.
+type Binding struct {
+	typ           reflect.Type
+	key           string
+	snapshot      atomic.Value
+	lock          sync.Mutex
+	settings      map[string]interface{}
+	subscriptions []*subscription
+}
+
+type subscription struct {
+	path string
+	f    func(config interface{})
+}
+
+// NewBinding returns a binding for the struct type of prototype, decoded from the
+// subtree at key, or the whole config if key is empty.
+func NewBinding(prototype interface{}, key string) *Binding {
+	typ := reflect.TypeOf(prototype)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return &Binding{
+		typ: typ,
+		key: strings.ToLower(key),
+	}
+}
+
+// Bind binds prototype to the watcher, the config is decoded immediately and
+// then again on every change.
+func Bind(w *Watcher, prototype interface{}, key string) (*Binding, error) {
+	b := NewBinding(prototype, key)
+	err := b.Update(w.Viper())
+	if err != nil {
+		return nil, err
+	}
+	w.OnChange(func(v *viper.Viper) {
+		err := b.Update(v)
+		if err != nil {
+			log.WithError(err).Errorw("config update rejected, keep last good config", "key", key)
+		}
+	})
+	return b, nil
+}
+
+// Load returns the current config, a pointer to the bound struct type. The value
+// is shared and must not be modified.
+func (self *Binding) Load() interface{} {
+	return self.snapshot.Load()
+}
+
+// Subscribe registers f to be called with the new config when the subtree at
+// path, relative to the binding key, changes. An empty path matches any change.
+func (self *Binding) Subscribe(path string, f func(config interface{})) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.subscriptions = append(self.subscriptions, &subscription{
+		path: strings.ToLower(path),
+		f:    f,
+	})
+}
+
+// Update decodes, defaults and validates the config from v. On error the last
+// good config is kept. The settings are taken from v.AllSettings, so env and
+// flag overrides of the keys under the binding key apply.
+func (self *Binding) Update(v *viper.Viper) error {
+	settings := v.AllSettings()
+	if self.key != "" {
+		settings, _ = toStringMap(lookupPath(settings, self.key))
+		if settings == nil {
+			settings = map[string]interface{}{}
+		}
+	}
+	config := reflect.New(self.typ).Interface()
+	err := decode(settings, config)
+	if err != nil {
+		return errors.WithMessage(err, "decode config")
+	}
+	err = structs.SetDefaultsAndValidate(config)
+	if err != nil {
+		return errors.WithMessage(err, "validate config")
+	}
+
+	self.lock.Lock()
+	old := self.settings
+	self.settings = settings
+	self.snapshot.Store(config)
+	changed := []*subscription{}
+	for _, s := range self.subscriptions {
+		if old == nil || !reflect.DeepEqual(lookupPath(old, s.path), lookupPath(settings, s.path)) {
+			changed = append(changed, s)
+		}
+	}
+	self.lock.Unlock()
+
+	if old == nil {
+		return nil
+	}
+	for _, s := range changed {
+		s.f(config)
+	}
+	return nil
+}
+
+// decode decodes settings as viper's Unmarshal does.
+func decode(settings map[string]interface{}, output interface{}) error {
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           output,
+		WeaklyTypedInput: true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	})
+	if err != nil {
+		return err
+	}
+	return d.Decode(settings)
+}
+
+func lookupPath(settings map[string]interface{}, path string) interface{} {
+	if path == "" {
+		return settings
+	}
+	var value interface{} = settings
+	for _, part := range strings.Split(path, ".") {
+		m, ok := toStringMap(value)
+		if !ok {
+			return nil
+		}
+		value = m[part]
+	}
+	return value
+}
@@ -0,0 +1,102 @@
+package conf_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.yym.plus/zeus/pkg/conf"
+)
+
+type appConfig struct {
+	Name  string `validate:"required"`
+	Redis struct {
+		Addr string `default:"127.0.0.1:6379"`
+	}
+	Http struct {
+		Port int `validate:"gt=0"`
+	}
+}
+
+func TestBinding(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.yml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("name: a\nhttp:\n  port: 80\n")
+
+	w, err := conf.NewWatcher(&conf.Source{Type: "file", ContentType: "yaml", URI: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	b, err := conf.Bind(w, &appConfig{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := b.Load().(*appConfig)
+	if config.Name != "a" || config.Http.Port != 80 || config.Redis.Addr != "127.0.0.1:6379" {
+		t.Fatalf("unexpected config %+v", config)
+	}
+
+	httpChanged := make(chan *appConfig, 10)
+	redisChanged := make(chan *appConfig, 10)
+	b.Subscribe("http", func(c interface{}) {
+		httpChanged <- c.(*appConfig)
+	})
+	b.Subscribe("redis", func(c interface{}) {
+		redisChanged <- c.(*appConfig)
+	})
+	err = w.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("name: a\nhttp:\n  port: 81\n")
+	select {
+	case c := <-httpChanged:
+		if c.Http.Port != 81 {
+			t.Fatalf("unexpected port %d", c.Http.Port)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("http subscription not fired")
+	}
+	if len(redisChanged) != 0 {
+		t.Fatal("redis subscription fired without change")
+	}
+
+	// invalid update keeps the last good config
+	write("name: ''\nhttp:\n  port: 82\n")
+	time.Sleep(300 * time.Millisecond)
+	if b.Load().(*appConfig).Http.Port != 81 {
+		t.Fatal("invalid config should be rejected")
+	}
+}
+
+func TestBindingKeyOverrides(t *testing.T) {
+	os.Setenv("ZEUS_DB_HOST", "env-host")
+	defer os.Unsetenv("ZEUS_DB_HOST")
+	v, err := conf.NewViperFromSource(&conf.Source{Type: "file", URI: "testdata/default.yml"}, conf.WithEnv("zeus"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := conf.NewBinding(&struct {
+		Host string
+		Port int
+	}{}, "db")
+	err = b.Update(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := b.Load().(*struct {
+		Host string
+		Port int
+	})
+	if config.Host != "env-host" {
+		t.Fatalf("env override lost, got %+v", config)
+	}
+}
@@ -0,0 +1,68 @@
+package conf
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/bketelsen/crypt/backend"
+	"github.com/pkg/errors"
+
+	"go.yym.plus/zeus/pkg/log"
+)
+
+// fetch gets key from the remote store of the source. With CacheDir set the
+// content is persisted on success and the persisted one is returned when the
+// remote is unreachable, the key of the source is then reported as stale.
+func (self *Source) fetch(store backend.Store, key string) ([]byte, error) {
+	data, err := store.Get(key)
+	if self.CacheDir == "" {
+		return data, err
+	}
+	name := self.layerName()
+	file := filepath.Join(self.CacheDir, self.cacheName(key))
+	if err == nil {
+		metricsConfigStale.WithLabelValues(name, key).Set(0)
+		if werr := writeCacheFile(file, data); werr != nil {
+			log.WithError(werr).Warnw("write config cache error", "source", name, "file", file)
+		}
+		return data, nil
+	}
+	cached, cerr := ioutil.ReadFile(file)
+	if cerr != nil {
+		return nil, err
+	}
+	log.WithError(err).Warnw("remote config unreachable, running on cached config", "source", name, "key", key, "file", file)
+	metricsConfigStale.WithLabelValues(name, key).Set(1)
+	return cached, nil
+}
+
+// cacheName is derived from the full uri so sources never share a cache file,
+// the uri itself is not written to disk.
+func (self *Source) cacheName(key string) string {
+	sum := sha1.Sum([]byte(self.Type + "\n" + self.URI + "\n" + key))
+	return self.Type + "-" + hex.EncodeToString(sum[:]) + ".cache"
+}
+
+// writeCacheFile replaces the file atomically so a crash never leaves a partial cache.
+func writeCacheFile(file string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.WithMessage(err, "write config cache")
+	}
+	return os.Rename(tmp.Name(), file)
+}
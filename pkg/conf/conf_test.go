@@ -2,8 +2,10 @@ package conf_test
 
 import (
 	"fmt"
+	"os"
 	"testing"
 
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	"go.yym.plus/zeus/pkg/conf"
@@ -22,4 +24,84 @@ func TestNacos(t *testing.T) {
 
 func TestSource(t *testing.T) {
 
-}
\ No newline at end of file
+}
+
+func TestLayered(t *testing.T) {
+	os.Setenv("ZEUS_DB_PORT", "3307")
+	defer os.Unsetenv("ZEUS_DB_PORT")
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("http.addr", ":80", "")
+	flags.String("name", "flag", "")
+	err := flags.Parse([]string{"--http.addr=:9090"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := viper.New()
+	v.SetConfigFile("testdata/layered.yml")
+	err = v.ReadInConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := conf.Source{}
+	err = v.Unmarshal(&source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.Layers[4].FlagSet = flags
+
+	l, err := conf.NewLayered(&source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expects := []struct {
+		key    string
+		value  string
+		origin string
+	}{
+		{"name", "zeus", "file:testdata/default.yml"},
+		{"db.host", "mysql.prod", "file:testdata/prod.yml"},
+		{"db.port", "3307", "env:zeus"},
+		{"http.addr", ":9090", "flag"},
+		{"db", "", "env:zeus"},
+	}
+	for _, e := range expects {
+		if e.value != "" && l.GetString(e.key) != e.value {
+			t.Errorf("%s expect %s, got %s", e.key, e.value, l.GetString(e.key))
+		}
+		if l.Origin(e.key) != e.origin {
+			t.Errorf("%s expect origin %s, got %s", e.key, e.origin, l.Origin(e.key))
+		}
+	}
+}
+
+func TestEnvAndFlagBinding(t *testing.T) {
+	os.Setenv("ZEUS_DB_HOST", "env-host")
+	defer os.Unsetenv("ZEUS_DB_HOST")
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.Int("db.port", 0, "")
+	err := flags.Parse([]string{"--db.port=3310"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := conf.NewViperFromSource(&conf.Source{Type: "file", URI: "testdata/default.yml"},
+		conf.WithEnv("zeus"), conf.WithFlagSet(flags))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := struct {
+		Name string
+		DB   struct {
+			Host string
+			Port int
+		}
+	}{}
+	err = v.Unmarshal(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "zeus" || config.DB.Host != "env-host" || config.DB.Port != 3310 {
+		t.Fatalf("unexpected config %+v", config)
+	}
+}
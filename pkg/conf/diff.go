@@ -0,0 +1,82 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Change is a leaf key whose value differs between two configs. Old is nil for
+// added keys and New is nil for removed keys.
+type Change struct {
+	Key string
+	Old interface{}
+	New interface{}
+}
+
+// ParseSettings parses config content of contentType, such as yaml or json, into
+// the settings viper would load from it.
+func ParseSettings(data []byte, contentType string) (map[string]interface{}, error) {
+	v := viper.New()
+	v.SetConfigType(contentType)
+	err := v.ReadConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.WithMessage(err, "parse config")
+	}
+	return v.AllSettings(), nil
+}
+
+// Diff compares the leaves of two settings, nested maps are walked and lists are
+// compared as a whole. Changes are sorted by key.
+func Diff(old, new map[string]interface{}) []*Change {
+	oldLeaves := map[string]interface{}{}
+	newLeaves := map[string]interface{}{}
+	flattenSettings(old, "", oldLeaves)
+	flattenSettings(new, "", newLeaves)
+	changes := []*Change{}
+	for key, o := range oldLeaves {
+		n, ok := newLeaves[key]
+		if !ok {
+			changes = append(changes, &Change{Key: key, Old: o})
+		} else if !reflect.DeepEqual(o, n) {
+			changes = append(changes, &Change{Key: key, Old: o, New: n})
+		}
+	}
+	for key, n := range newLeaves {
+		if _, ok := oldLeaves[key]; !ok {
+			changes = append(changes, &Change{Key: key, New: n})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+// String formats the change as "+ key: new", "- key: old" or "~ key: old -> new".
+func (self *Change) String() string {
+	switch {
+	case self.Old == nil:
+		return fmt.Sprintf("+ %s: %v", self.Key, self.New)
+	case self.New == nil:
+		return fmt.Sprintf("- %s: %v", self.Key, self.Old)
+	default:
+		return fmt.Sprintf("~ %s: %v -> %v", self.Key, self.Old, self.New)
+	}
+}
+
+func flattenSettings(settings map[string]interface{}, prefix string, leaves map[string]interface{}) {
+	for k, v := range settings {
+		key := strings.ToLower(prefix + k)
+		if m, ok := toStringMap(v); ok && len(m) > 0 {
+			flattenSettings(m, key+".", leaves)
+			continue
+		}
+		leaves[key] = v
+	}
+}
@@ -0,0 +1,48 @@
+package conf_test
+
+import (
+	"testing"
+
+	"go.yym.plus/zeus/pkg/conf"
+)
+
+func TestDiff(t *testing.T) {
+	old, err := conf.ParseSettings([]byte(`
+name: zeus
+http:
+  addr: ":8080"
+db:
+  uri: root@/app
+  hosts: [a, b]
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	new, err := conf.ParseSettings([]byte(`
+name: zeus
+http:
+  addr: ":9090"
+  logger:
+    enable: false
+db:
+  hosts: [a, c]
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := conf.Diff(old, new)
+	expect := []string{
+		"~ db.hosts: [a b] -> [a c]",
+		"- db.uri: root@/app",
+		"~ http.addr: :8080 -> :9090",
+		"+ http.logger.enable: false",
+	}
+	if len(changes) != len(expect) {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+	for i, change := range changes {
+		if change.String() != expect[i] {
+			t.Fatalf("expect %q, got %q", expect[i], change.String())
+		}
+	}
+}
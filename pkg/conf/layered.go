@@ -0,0 +1,281 @@
+package conf
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Layered is the viper merged from the layers of a "layered" Source. Later
+// layers override earlier ones, usually defaults file, environment file, nacos,
+// environment variables and then command-line flags.
+type Layered struct {
+	*viper.Viper
+	source   *Source
+	layers   []string
+	origins  map[string]string
+	settings map[string]interface{}
+}
+
+// NewLayered merges the layers of s in order and records which layer supplied
+// each effective key.
+func NewLayered(s *Source, opts ...Option) (*Layered, error) {
+	s = s.with(opts...)
+	l, err := newLayered(s)
+	if err != nil {
+		return nil, err
+	}
+	err = s.resolveSecrets(l.Viper)
+	if err != nil {
+		return nil, err
+	}
+	err = s.bind(l.Viper)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func newLayered(s *Source) (*Layered, error) {
+	if s.Type != "layered" {
+		return nil, fmt.Errorf("config source type %s is not layered", s.Type)
+	}
+	l := &Layered{
+		source:   s,
+		Viper:    viper.New(),
+		origins:  map[string]string{},
+		settings: map[string]interface{}{},
+	}
+	for i, layer := range s.Layers {
+		name := layer.layerName()
+		settings, err := l.load(layer)
+		if err != nil {
+			if layer.Optional {
+				continue
+			}
+			return nil, errors.WithMessagef(err, "load config layer %d %s", i, name)
+		}
+		// viper's merge skips values whose type differs, env and flags are strings
+		mergeSettings(l.settings, settings)
+		for _, key := range flattenKeys(settings, "") {
+			l.origins[key] = name
+		}
+		l.layers = append(l.layers, name)
+	}
+	err := l.MergeConfigMap(l.settings)
+	if err != nil {
+		return nil, errors.WithMessage(err, "merge config layers")
+	}
+	return l, nil
+}
+
+// Origin returns the name of the layer which supplied the effective value of key,
+// or an empty string if no layer has it.
+func (self *Layered) Origin(key string) string {
+	key = strings.ToLower(key)
+	if self.source.FlagSet != nil {
+		if flag := self.source.FlagSet.Lookup(key); flag != nil && flag.Changed {
+			return "flag"
+		}
+	}
+	if self.source.envEnabled() {
+		name := self.source.envName(key)
+		if _, ok := os.LookupEnv(name); ok {
+			return "env:" + name
+		}
+	}
+	if origin, ok := self.origins[key]; ok {
+		return origin
+	}
+	// a map key is supplied by the layer of its last merged leaf
+	origin := ""
+	for k, o := range self.origins {
+		if strings.HasPrefix(k, key+".") {
+			origin = self.laterLayer(origin, o)
+		}
+	}
+	return origin
+}
+
+// Origins returns the layer of every effective leaf key.
+func (self *Layered) Origins() map[string]string {
+	origins := make(map[string]string, len(self.origins))
+	for k, v := range self.origins {
+		origins[k] = v
+	}
+	return origins
+}
+
+// Layers returns the names of the loaded layers in merge order.
+func (self *Layered) Layers() []string {
+	return self.layers
+}
+
+func (self *Layered) laterLayer(a, b string) string {
+	for i := len(self.layers) - 1; i >= 0; i-- {
+		if self.layers[i] == a || self.layers[i] == b {
+			return self.layers[i]
+		}
+	}
+	return b
+}
+
+func (self *Layered) load(layer *Source) (map[string]interface{}, error) {
+	switch layer.Type {
+	case "env":
+		return self.loadEnv(layer.URI), nil
+	case "flag":
+		flags := layer.FlagSet
+		if flags == nil {
+			flags = self.source.FlagSet
+		}
+		if flags == nil {
+			flags = pflag.CommandLine
+		}
+		return self.loadFlags(flags), nil
+	case "layered":
+		return nil, fmt.Errorf("layered source can not be nested")
+	default:
+		v, err := newViper(layer)
+		if err != nil {
+			return nil, err
+		}
+		return v.AllSettings(), nil
+	}
+}
+
+// loadEnv looks up the keys known by earlier layers in the environment, key
+// "db.host" with prefix "app" is APP_DB_HOST.
+func (self *Layered) loadEnv(prefix string) map[string]interface{} {
+	settings := map[string]interface{}{}
+	for _, key := range flattenKeys(self.settings, "") {
+		name := strings.ToUpper(strings.Replace(key, ".", "_", -1))
+		if prefix != "" {
+			name = strings.ToUpper(prefix) + "_" + name
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			setPath(settings, key, value)
+		}
+	}
+	return settings
+}
+
+// loadFlags takes changed flags, and defaults of flags whose key no earlier layer has.
+func (self *Layered) loadFlags(flags *pflag.FlagSet) map[string]interface{} {
+	settings := map[string]interface{}{}
+	flags.VisitAll(func(flag *pflag.Flag) {
+		key := strings.ToLower(flag.Name)
+		if !flag.Changed && lookupPath(self.settings, key) != nil {
+			return
+		}
+		setPath(settings, key, flagValue(flag))
+	})
+	return settings
+}
+
+func flagValue(flag *pflag.Flag) interface{} {
+	value := flag.Value.String()
+	switch flag.Value.Type() {
+	case "stringSlice", "stringArray", "intSlice", "boolSlice", "durationSlice":
+		return strings.Split(strings.Trim(value, "[]"), ",")
+	}
+	return value
+}
+
+func (self *Source) layerName() string {
+	if self.Name != "" {
+		return self.Name
+	}
+	switch self.Type {
+	case "flag":
+		return "flag"
+	case "nacos":
+		// never leak the credentials of the uri
+		uri, hosts := splitNacosHosts(self.URI)
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "nacos"
+		}
+		u.User = nil
+		u.Host = strings.Join(hosts, ",")
+		query := u.Query()
+		if query.Get("secretKey") != "" {
+			query.Del("secretKey")
+			u.RawQuery = query.Encode()
+		}
+		return "nacos:" + u.String()
+	case "file", "env":
+		return self.Type + ":" + self.URI
+	default:
+		// the userinfo and query of remote uris may hold credentials
+		u, err := url.Parse(self.URI)
+		if err != nil {
+			return self.Type
+		}
+		u.User = nil
+		u.RawQuery = ""
+		u.Fragment = ""
+		return self.Type + ":" + u.String()
+	}
+}
+
+func setPath(settings map[string]interface{}, key string, value interface{}) {
+	parts := strings.Split(key, ".")
+	m := settings
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := m[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			m[part] = next
+		}
+		m = next
+	}
+	m[parts[len(parts)-1]] = value
+}
+
+func mergeSettings(dst map[string]interface{}, src map[string]interface{}) {
+	for k, v := range src {
+		k = strings.ToLower(k)
+		if sm, ok := toStringMap(v); ok {
+			dm, ok := dst[k].(map[string]interface{})
+			if !ok {
+				dm = map[string]interface{}{}
+				dst[k] = dm
+			}
+			mergeSettings(dm, sm)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+func flattenKeys(settings map[string]interface{}, prefix string) []string {
+	keys := []string{}
+	for k, v := range settings {
+		key := strings.ToLower(prefix + k)
+		if m, ok := toStringMap(v); ok && len(m) > 0 {
+			keys = append(keys, flattenKeys(m, key+".")...)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// toStringMap converts the maps yaml and json decode to, unlike cast it never
+// parses strings.
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		return cast.ToStringMap(m), true
+	}
+	return nil, false
+}
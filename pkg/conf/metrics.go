@@ -0,0 +1,16 @@
+package conf
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	metricsConfigStale = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "zeus",
+		Subsystem: "conf",
+		Name:      "stale",
+		Help:      "1 if the config of the source key is loaded from the local cache because the remote is unreachable.",
+	}, []string{"source", "key"})
+)
+
+func init() {
+	prometheus.MustRegister(metricsConfigStale)
+}
@@ -0,0 +1,196 @@
+package conf
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NacosRevision is an entry of the nacos config history. Nacos records the
+// content a config had before each update or delete, so the newest revision
+// holds the previous version.
+type NacosRevision struct {
+	ID       string
+	OpType   string
+	Modified time.Time
+	MD5      string
+	SrcUser  string
+	SrcIP    string
+	Content  string
+}
+
+type nacosRevision struct {
+	ID               json.Number     `json:"id"`
+	OpType           string          `json:"opType"`
+	LastModifiedTime json.RawMessage `json:"lastModifiedTime"`
+	MD5              string          `json:"md5"`
+	SrcUser          string          `json:"srcUser"`
+	SrcIP            string          `json:"srcIp"`
+	Content          string          `json:"content"`
+}
+
+// History returns the newest revisions of the dataID of key, at most limit,
+// newest first. The content of the revisions is not loaded, see Revision.
+func (self *NacosBackend) History(key string, limit int) ([]*NacosRevision, error) {
+	if limit <= 0 {
+		limit = 10
+	}
+	var page struct {
+		PageItems []*nacosRevision `json:"pageItems"`
+	}
+	err := self.historyRequest(key, url.Values{
+		"search":   {"accurate"},
+		"pageNo":   {"1"},
+		"pageSize": {strconv.Itoa(limit)},
+	}, &page)
+	if err != nil {
+		return nil, err
+	}
+	revisions := []*NacosRevision{}
+	for _, item := range page.PageItems {
+		revisions = append(revisions, item.revision())
+	}
+	return revisions, nil
+}
+
+// Revision returns the revision id of the dataID of key with its content.
+func (self *NacosBackend) Revision(key string, id string) (*NacosRevision, error) {
+	item := &nacosRevision{}
+	err := self.historyRequest(key, url.Values{"nid": {id}}, item)
+	if err != nil {
+		return nil, err
+	}
+	if item.ID == "" {
+		return nil, fmt.Errorf("nacos revision %s of %s not found", id, self.dataID(key))
+	}
+	return item.revision(), nil
+}
+
+// historyRequest queries the history api, which the sdk doesn't cover, trying
+// the servers in order.
+func (self *NacosBackend) historyRequest(key string, query url.Values, out interface{}) error {
+	if self.options == nil {
+		return fmt.Errorf("nacos history needs a backend created by NewNacosBackend")
+	}
+	client := &http.Client{
+		Timeout: time.Duration(self.options.clientConfig.TimeoutMs) * time.Millisecond,
+	}
+	if self.options.tlsConfig != nil {
+		client.Transport = newNacosHTTPSAgent(self.options.tlsConfig).transport
+	}
+	query.Set("dataId", self.dataID(key))
+	query.Set("group", self.group)
+	query.Set("tenant", self.options.clientConfig.NamespaceId)
+
+	var lastErr error
+	for _, server := range self.options.serverConfigs {
+		contextPath := strings.TrimSuffix(server.ContextPath, "/")
+		if contextPath == "" {
+			contextPath = "/nacos"
+		}
+		base := fmt.Sprintf("%s://%s:%d%s", server.Scheme, server.IpAddr, server.Port, contextPath)
+		lastErr = self.historyGet(client, base, query, out)
+		if lastErr == nil {
+			return nil
+		}
+	}
+	return errors.WithMessage(lastErr, "nacos history")
+}
+
+func (self *NacosBackend) historyGet(client *http.Client, base string, query url.Values, out interface{}) error {
+	clientConfig := self.options.clientConfig
+	values := url.Values{}
+	for k, v := range query {
+		values[k] = v
+	}
+	if clientConfig.Username != "" {
+		token, err := nacosLogin(client, base, clientConfig.Username, clientConfig.Password)
+		if err != nil {
+			return err
+		}
+		values.Set("accessToken", token)
+	}
+	req, err := http.NewRequest(http.MethodGet, base+"/v1/cs/history?"+values.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if clientConfig.AccessKey != "" {
+		timestamp := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+		mac := hmac.New(sha1.New, []byte(clientConfig.SecretKey))
+		mac.Write([]byte(query.Get("tenant") + "+" + query.Get("group") + "+" + timestamp))
+		req.Header.Set("Spas-AccessKey", clientConfig.AccessKey)
+		req.Header.Set("Timestamp", timestamp)
+		req.Header.Set("Spas-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, out)
+}
+
+func nacosLogin(client *http.Client, base, username, password string) (string, error) {
+	resp, err := client.PostForm(base+"/v1/auth/users/login", url.Values{
+		"username": {username},
+		"password": {password},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("nacos login status %d", resp.StatusCode)
+	}
+	var result struct {
+		AccessToken string `json:"accessToken"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", errors.WithMessage(err, "nacos login")
+	}
+	return result.AccessToken, nil
+}
+
+// revision converts the api item, lastModifiedTime is epoch milliseconds or a
+// formatted time depending on the nacos version.
+func (self *nacosRevision) revision() *NacosRevision {
+	revision := &NacosRevision{
+		ID:      self.ID.String(),
+		OpType:  strings.TrimSpace(self.OpType),
+		MD5:     self.MD5,
+		SrcUser: self.SrcUser,
+		SrcIP:   self.SrcIP,
+		Content: self.Content,
+	}
+	var millis int64
+	var formatted string
+	if json.Unmarshal(self.LastModifiedTime, &millis) == nil {
+		revision.Modified = time.Unix(0, millis*int64(time.Millisecond))
+	} else if json.Unmarshal(self.LastModifiedTime, &formatted) == nil {
+		for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05"} {
+			if t, err := time.ParseInLocation(layout, formatted, time.Local); err == nil {
+				revision.Modified = t
+				break
+			}
+		}
+	}
+	return revision
+}
@@ -0,0 +1,119 @@
+package conf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+)
+
+// nacosHTTPSAgent sends the requests of the nacos sdk over https. The sdk builds
+// http:// urls for config requests whatever the server scheme is, so they are
+// upgraded here.
+type nacosHTTPSAgent struct {
+	transport *http.Transport
+}
+
+// parseNacosTLS returns the tls config of the nacos uri query, nil if tls is off.
+func parseNacosTLS(query url.Values) (*tls.Config, error) {
+	ca := query.Get("tlsCA")
+	skipVerify := cast.ToBool(query.Get("tlsSkipVerify"))
+	if !cast.ToBool(query.Get("tls")) && ca == "" && !skipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{
+		InsecureSkipVerify: skipVerify,
+	}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, errors.WithMessage(err, "read nacos tlsCA")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("nacos tlsCA %s has no certificate", ca)
+		}
+	}
+	return config, nil
+}
+
+func newNacosHTTPSAgent(config *tls.Config) *nacosHTTPSAgent {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &nacosHTTPSAgent{
+		transport: transport,
+	}
+}
+
+func (self *nacosHTTPSAgent) Get(path string, header http.Header, timeoutMs uint64, params map[string]string) (*http.Response, error) {
+	return self.Request(http.MethodGet, path, header, timeoutMs, params)
+}
+
+func (self *nacosHTTPSAgent) Post(path string, header http.Header, timeoutMs uint64, params map[string]string) (*http.Response, error) {
+	return self.Request(http.MethodPost, path, header, timeoutMs, params)
+}
+
+func (self *nacosHTTPSAgent) Delete(path string, header http.Header, timeoutMs uint64, params map[string]string) (*http.Response, error) {
+	return self.Request(http.MethodDelete, path, header, timeoutMs, params)
+}
+
+func (self *nacosHTTPSAgent) Put(path string, header http.Header, timeoutMs uint64, params map[string]string) (*http.Response, error) {
+	return self.Request(http.MethodPut, path, header, timeoutMs, params)
+}
+
+func (self *nacosHTTPSAgent) RequestOnlyResult(method string, path string, header http.Header, timeoutMs uint64, params map[string]string) string {
+	resp, err := self.Request(method, path, header, timeoutMs, params)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func (self *nacosHTTPSAgent) Request(method string, path string, header http.Header, timeoutMs uint64, params map[string]string) (*http.Response, error) {
+	if strings.HasPrefix(path, "http://") {
+		path = "https://" + strings.TrimPrefix(path, "http://")
+	}
+	values := url.Values{}
+	for k, v := range params {
+		values.Set(k, v)
+	}
+	var body *strings.Reader
+	switch method {
+	case http.MethodGet, http.MethodDelete:
+		if len(values) > 0 {
+			path += "?" + values.Encode()
+		}
+		body = strings.NewReader("")
+	case http.MethodPost, http.MethodPut:
+		body = strings.NewReader(values.Encode())
+	default:
+		return nil, fmt.Errorf("nacos request method %s not supported", method)
+	}
+	req, err := http.NewRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		req.Header = header
+	}
+	client := &http.Client{
+		Transport: self.transport,
+		Timeout:   time.Millisecond * time.Duration(timeoutMs),
+	}
+	return client.Do(req)
+}
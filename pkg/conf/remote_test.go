@@ -0,0 +1,126 @@
+package conf_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"go.yym.plus/zeus/pkg/conf"
+)
+
+const remoteConfig = "name: remote\ndb:\n  port: 3306\n"
+
+func TestEtcdSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/keys/config/app.yml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Etcd-Index", "1")
+		fmt.Fprintf(w, `{"action":"get","node":{"key":"/config/app.yml","value":%q,"modifiedIndex":1,"createdIndex":1}}`, remoteConfig)
+	}))
+	defer server.Close()
+
+	v, err := conf.NewViperFromSource(&conf.Source{
+		Type: "etcd",
+		URI:  "etcd://" + strings.TrimPrefix(server.URL, "http://") + "/config/app.yml",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.GetString("name") != "remote" || v.GetInt("db.port") != 3306 {
+		t.Fatalf("unexpected config %v", v.AllSettings())
+	}
+}
+
+func TestConsulSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/config/app" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Consul-Index", "1")
+		fmt.Fprintf(w, `[{"Key":"config/app","Value":%q,"ModifyIndex":1}]`, base64.StdEncoding.EncodeToString([]byte(remoteConfig)))
+	}))
+	defer server.Close()
+
+	v, err := conf.NewViperFromSource(&conf.Source{
+		Type:        "consul",
+		ContentType: "yaml",
+		URI:         "consul://" + strings.TrimPrefix(server.URL, "http://") + "/config/app",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.GetString("name") != "remote" {
+		t.Fatalf("unexpected config %v", v.AllSettings())
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	lock := sync.Mutex{}
+	content := remoteConfig
+	notModified := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		etag := fmt.Sprintf(`"%d"`, len(content))
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+
+	w, err := conf.NewWatcher(&conf.Source{
+		Type:         "http",
+		URI:          server.URL + "/config/app.yaml",
+		PollInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	if w.Viper().GetString("name") != "remote" {
+		t.Fatalf("unexpected config %v", w.Viper().AllSettings())
+	}
+	changes := int32(0)
+	w.OnChange(func(v *viper.Viper) {
+		atomic.AddInt32(&changes, 1)
+	})
+	err = w.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	if notModified == 0 {
+		t.Error("poll should be answered with 304")
+	}
+	if atomic.LoadInt32(&changes) != 0 {
+		t.Error("unchanged config should not be reloaded")
+	}
+	content = "name: changed\n"
+	lock.Unlock()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for w.Viper().GetString("name") != "changed" {
+		if time.Now().After(deadline) {
+			t.Fatal("http config change not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,427 @@
+// Package schema keeps the config structs of modules registered by the
+// application under their key in its config, so a whole config file can be
+// validated before deploy and reference docs can be generated from the same
+// structs. Modules export their schema rather than register themselves, as the
+// keys, and how many of each, are up to the application:
+//
+//	schema.Register("orders_db", sql.EngineSchema)
+//	schema.Register("users_db", sql.EngineSchema)
+package schema
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+
+	"go.yym.plus/zeus/pkg/utils/structs"
+)
+
+var (
+	defaultRegistry = NewRegistry()
+
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Registry maps config keys, dot separated paths in the application config, to
+// config struct types.
+type Registry struct {
+	lock    sync.RWMutex
+	entries map[string]reflect.Type
+}
+
+// ValidationError is the error of the config under one key.
+type ValidationError struct {
+	Key string
+	Err error
+}
+
+// ValidationErrors collects the errors of all invalid keys.
+type ValidationErrors []*ValidationError
+
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: map[string]reflect.Type{},
+	}
+}
+
+// Default returns the registry the application registers module configs to.
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// Register registers prototype to the default registry.
+func Register(key string, prototype interface{}) {
+	defaultRegistry.Register(key, prototype)
+}
+
+// Validate validates v against the default registry.
+func Validate(v *viper.Viper) error {
+	return defaultRegistry.Validate(v)
+}
+
+// Reference returns the reference YAML of the default registry.
+func Reference() ([]byte, error) {
+	return defaultRegistry.Reference()
+}
+
+// JSONSchema returns the JSON Schema of the default registry.
+func JSONSchema() ([]byte, error) {
+	return defaultRegistry.JSONSchema()
+}
+
+// Register registers the struct type of prototype under key. It panics if
+// prototype is not a struct or key is already registered.
+func (self *Registry) Register(key string, prototype interface{}) {
+	typ := reflect.TypeOf(prototype)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("schema: config of %s must be a struct", key))
+	}
+	key = strings.ToLower(key)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.entries[key]; ok {
+		panic(fmt.Sprintf("schema: config %s registered twice", key))
+	}
+	self.entries[key] = typ
+}
+
+// Keys returns the registered keys in order.
+func (self *Registry) Keys() []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	keys := make([]string, 0, len(self.entries))
+	for key := range self.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (self *Registry) get(key string) reflect.Type {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.entries[key]
+}
+
+// Validate decodes every registered key present in v into its struct, rejecting
+// unknown fields, then sets defaults and validates it. Keys absent from v are
+// modules the application doesn't use and are skipped.
+func (self *Registry) Validate(v *viper.Viper) error {
+	errs := ValidationErrors{}
+	for _, key := range self.Keys() {
+		if !v.IsSet(key) {
+			continue
+		}
+		var settings interface{}
+		if sub := v.Sub(key); sub != nil {
+			settings = sub.AllSettings()
+		} else {
+			settings = v.Get(key)
+		}
+		config := reflect.New(self.get(key)).Interface()
+		err := decode(settings, config)
+		if err == nil {
+			err = structs.SetDefaultsAndValidate(config)
+		}
+		if err != nil {
+			errs = append(errs, &ValidationError{Key: key, Err: err})
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Reference returns a YAML document with every registered config and all its
+// fields set to their defaults.
+func (self *Registry) Reference() ([]byte, error) {
+	doc := yaml.MapSlice{}
+	for _, key := range self.Keys() {
+		config := reflect.New(self.get(key))
+		err := structs.SetDefaults(config.Interface())
+		if err != nil {
+			return nil, err
+		}
+		doc = insertPath(doc, strings.Split(key, "."), referenceValue(config.Elem()))
+	}
+	return yaml.Marshal(doc)
+}
+
+// JSONSchema returns a draft-07 JSON Schema of the registered configs, for
+// editors and CI checks that don't run Go.
+func (self *Registry) JSONSchema() ([]byte, error) {
+	root := map[string]interface{}{
+		"$schema":    "http://json-schema.org/draft-07/schema#",
+		"type":       "object",
+		"properties": map[string]interface{}{},
+	}
+	for _, key := range self.Keys() {
+		config := reflect.New(self.get(key))
+		err := structs.SetDefaults(config.Interface())
+		if err != nil {
+			return nil, err
+		}
+		node := root
+		parts := strings.Split(key, ".")
+		for _, part := range parts[:len(parts)-1] {
+			properties := node["properties"].(map[string]interface{})
+			child, ok := properties[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{
+					"type":       "object",
+					"properties": map[string]interface{}{},
+				}
+				properties[part] = child
+			}
+			node = child
+		}
+		node["properties"].(map[string]interface{})[parts[len(parts)-1]] = schemaOf(config.Elem())
+	}
+	return json.MarshalIndent(root, "", "  ")
+}
+
+func (self *ValidationError) Error() string {
+	return self.Key + ": " + self.Err.Error()
+}
+
+func (self ValidationErrors) Error() string {
+	lines := make([]string, 0, len(self))
+	for _, err := range self {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func decode(input, output interface{}) error {
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           output,
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			textUnmarshalerHook,
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	})
+	if err != nil {
+		return err
+	}
+	return d.Decode(input)
+}
+
+// textUnmarshalerHook decodes strings into types implementing
+// encoding.TextUnmarshaler, such as log.Duration.
+func textUnmarshalerHook(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+	if f.Kind() != reflect.String || !reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return data, nil
+	}
+	result := reflect.New(t)
+	err := result.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(data.(string)))
+	if err != nil {
+		return nil, err
+	}
+	return result.Elem().Interface(), nil
+}
+
+type field struct {
+	name       string
+	value      reflect.Value
+	hasDefault bool
+	validate   string
+}
+
+// fields returns the exported fields of struct value v as they are named in
+// config files.
+func fields(v reflect.Value) []*field {
+	result := []*field{}
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("mapstructure"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = lowerCamel(f.Name)
+		}
+		_, hasDefault := f.Tag.Lookup("default")
+		result = append(result, &field{
+			name:       name,
+			value:      v.Field(i),
+			hasDefault: hasDefault,
+			validate:   f.Tag.Get("validate"),
+		})
+	}
+	return result
+}
+
+// lowerCamel lowers the leading upper case run of name, keeping the last upper
+// case letter when it starts the next word: DB -> db, MaxRetries -> maxRetries,
+// URLPath -> urlPath.
+func lowerCamel(name string) string {
+	runes := []rune(name)
+	for i := 0; i < len(runes) && unicode.IsUpper(runes[i]); i++ {
+		if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			break
+		}
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
+
+func insertPath(doc yaml.MapSlice, path []string, value interface{}) yaml.MapSlice {
+	for i, item := range doc {
+		if item.Key != path[0] {
+			continue
+		}
+		if len(path) > 1 {
+			child, _ := item.Value.(yaml.MapSlice)
+			doc[i].Value = insertPath(child, path[1:], value)
+		} else {
+			doc[i].Value = value
+		}
+		return doc
+	}
+	if len(path) > 1 {
+		value = insertPath(yaml.MapSlice{}, path[1:], value)
+	}
+	return append(doc, yaml.MapItem{Key: path[0], Value: value})
+}
+
+func referenceValue(v reflect.Value) interface{} {
+	if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().Type().Implements(textMarshalerType) {
+		text, err := v.Addr().Interface().(encoding.TextMarshaler).MarshalText()
+		if err == nil {
+			return string(text)
+		}
+	}
+	if v.Type() == durationType {
+		return v.Interface().(time.Duration).String()
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return referenceValue(reflect.Zero(v.Type().Elem()))
+		}
+		return referenceValue(v.Elem())
+	case reflect.Struct:
+		result := yaml.MapSlice{}
+		for _, f := range fields(v) {
+			result = append(result, yaml.MapItem{Key: f.name, Value: referenceValue(f.value)})
+		}
+		return result
+	case reflect.Map:
+		if v.Len() == 0 {
+			return map[string]interface{}{}
+		}
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return []interface{}{}
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+	}
+	return v.Interface()
+}
+
+// schemaOf returns the JSON Schema of v, v holds the defaults.
+func schemaOf(v reflect.Value) map[string]interface{} {
+	typ := v.Type()
+	if typ.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return schemaOf(reflect.Zero(typ.Elem()))
+		}
+		return schemaOf(v.Elem())
+	}
+	if reflect.PtrTo(typ).Implements(textUnmarshalerType) {
+		return map[string]interface{}{"type": "string"}
+	}
+	if typ == durationType {
+		return map[string]interface{}{
+			"type":    "string",
+			"pattern": `^(0|-?([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`,
+		}
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		required := []string{}
+		for _, f := range fields(v) {
+			property := schemaOf(f.value)
+			if f.hasDefault {
+				property["default"] = referenceValue(f.value)
+			}
+			for _, rule := range strings.Split(f.validate, ",") {
+				name, param := rule, ""
+				if i := strings.Index(rule, "="); i >= 0 {
+					name, param = rule[:i], rule[i+1:]
+				}
+				switch name {
+				case "required":
+					if !f.hasDefault {
+						required = append(required, f.name)
+					}
+				case "oneof":
+					enum := []interface{}{}
+					for _, item := range strings.Fields(param) {
+						enum = append(enum, item)
+					}
+					property["enum"] = enum
+				}
+			}
+			properties[f.name] = property
+		}
+		result := map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		}
+		if len(required) > 0 {
+			result["required"] = required
+		}
+		return result
+	case reflect.Map:
+		result := map[string]interface{}{"type": "object"}
+		if typ.Elem().Kind() != reflect.Interface {
+			result["additionalProperties"] = schemaOf(reflect.Zero(typ.Elem()))
+		}
+		return result
+	case reflect.Slice, reflect.Array:
+		result := map[string]interface{}{"type": "array"}
+		if typ.Elem().Kind() != reflect.Interface {
+			result["items"] = schemaOf(reflect.Zero(typ.Elem()))
+		}
+		return result
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	default:
+		return map[string]interface{}{}
+	}
+}
@@ -0,0 +1,167 @@
+package schema_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v2"
+
+	"go.yym.plus/zeus/pkg/conf/schema"
+	"go.yym.plus/zeus/pkg/log"
+)
+
+type serverConfig struct {
+	Addr    string `default:":8080" validate:"required"`
+	Mode    string `default:"release" validate:"oneof=debug release"`
+	Timeout time.Duration
+	Log     struct {
+		MaxAge log.Duration `default:"1m"`
+	}
+}
+
+type dbConfig struct {
+	Uri   string `validate:"required"`
+	MaxIO int
+}
+
+func newRegistry() *schema.Registry {
+	r := schema.NewRegistry()
+	r.Register("server", serverConfig{})
+	r.Register("mysql.main", &dbConfig{})
+	return r
+}
+
+func readYAML(t *testing.T, content string) *viper.Viper {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestValidate(t *testing.T) {
+	r := newRegistry()
+	err := r.Validate(readYAML(t, `
+server:
+  timeout: 3s
+  log:
+    maxAge: 7d
+mysql:
+  main:
+    uri: root@/app
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Validate(readYAML(t, "other: 1\n"))
+	if err != nil {
+		t.Fatal("absent keys should be skipped", err)
+	}
+
+	err = r.Validate(readYAML(t, `
+server:
+  mode: test
+  tiemout: 3s
+mysql:
+  main:
+    maxIO: 10
+`))
+	errs, ok := err.(schema.ValidationErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if errs[0].Key != "mysql.main" || !strings.Contains(errs[0].Error(), "Uri") {
+		t.Fatalf("unexpected error %v", errs[0])
+	}
+	if errs[1].Key != "server" || !strings.Contains(errs[1].Error(), "tiemout") {
+		t.Fatalf("unexpected error %v", errs[1])
+	}
+}
+
+func TestReferenceAndJSONSchema(t *testing.T) {
+	r := newRegistry()
+	reference, err := r.Reference()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `mysql:
+  main:
+    uri: ""
+    maxIO: 0
+server:
+  addr: :8080
+  mode: release
+  timeout: 0s
+  log:
+    maxAge: 1m0s
+`
+	if string(reference) != expect {
+		t.Fatalf("unexpected reference\n%s", reference)
+	}
+
+	jsonSchema, err := r.JSONSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader := gojsonschema.NewBytesLoader(jsonSchema)
+	doc := map[string]interface{}{}
+	err = yaml.Unmarshal(reference, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := gojsonschema.Validate(loader, gojsonschema.NewGoLoader(toJSON(doc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid() {
+		t.Fatalf("reference not valid: %v", result.Errors())
+	}
+	result, err = gojsonschema.Validate(loader, gojsonschema.NewGoLoader(map[string]interface{}{
+		"server": map[string]interface{}{"mode": "test", "timeout": "3 seconds"},
+		"mysql":  map[string]interface{}{"main": map[string]interface{}{}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Errors()) != 3 {
+		t.Fatalf("unexpected errors: %v", result.Errors())
+	}
+}
+
+func TestModuleSchema(t *testing.T) {
+	r := schema.NewRegistry()
+	r.Register("log", log.ConfigSchema)
+	reference, err := r.Reference()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(reference, []byte("log:\n")) || !bytes.Contains(reference, []byte("maxAge: 1m0s")) {
+		t.Fatalf("log config not registered\n%s", reference)
+	}
+}
+
+// toJSON converts the map[interface{}]interface{} yaml.v2 decodes into JSON
+// compatible values.
+func toJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, item := range v {
+			m[k.(string)] = toJSON(item)
+		}
+		return m
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = toJSON(item)
+		}
+		return v
+	default:
+		return value
+	}
+}
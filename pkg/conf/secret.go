@@ -0,0 +1,204 @@
+package conf
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SecretKeyFileEnv is the environment variable of the key file used when
+// Source.SecretKeyFile is empty.
+const SecretKeyFileEnv = "ZEUS_SECRET_KEY_FILE"
+
+var (
+	secretRefPattern = regexp.MustCompile(`\$\{(env|secret:file):([^}]+)\}`)
+	encPattern       = regexp.MustCompile(`^ENC\(([A-Za-z0-9+/=]+)\)$`)
+)
+
+// GenerateSecretKey returns a new random AES-256 key, base64 encoded as stored in key files.
+func GenerateSecretKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// LoadSecretKey reads a base64 encoded AES key from file.
+func LoadSecretKey(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithMessage(err, "read secret key file")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.WithMessage(err, "secret key must be base64")
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("secret key must be 16, 24 or 32 bytes, got %d", len(key))
+	}
+}
+
+// Encrypt encrypts value with AES-GCM and returns it as ENC(...).
+func Encrypt(key []byte, value string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return "ENC(" + base64.StdEncoding.EncodeToString(sealed) + ")", nil
+}
+
+// Decrypt decrypts a value returned by Encrypt.
+func Decrypt(key []byte, value string) (string, error) {
+	match := encPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return "", fmt.Errorf("encrypted value must be ENC(base64)")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(match[1])
+	if err != nil {
+		return "", errors.WithMessage(err, "encrypted value invalid")
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted value too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.WithMessage(err, "decrypt value, wrong key?")
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// secretResolver replaces ${env:NAME} and ${secret:file:PATH} references and
+// decrypts ENC(...) values, the key is loaded on first use.
+type secretResolver struct {
+	keyFile string
+	key     []byte
+}
+
+func (self *Source) secretResolver() *secretResolver {
+	keyFile := self.SecretKeyFile
+	if keyFile == "" {
+		keyFile = os.Getenv(SecretKeyFileEnv)
+	}
+	return &secretResolver{keyFile: keyFile}
+}
+
+func (self *secretResolver) resolve(value string) (string, error) {
+	var err error
+	value = secretRefPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		if err != nil {
+			return ref
+		}
+		match := secretRefPattern.FindStringSubmatch(ref)
+		switch match[1] {
+		case "env":
+			v, ok := os.LookupEnv(match[2])
+			if !ok {
+				err = fmt.Errorf("env %s referenced by config not set", match[2])
+			}
+			return v
+		default:
+			data, rerr := ioutil.ReadFile(match[2])
+			if rerr != nil {
+				err = errors.WithMessagef(rerr, "read secret file %s", match[2])
+				return ref
+			}
+			return strings.TrimRight(string(data), "\r\n")
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if !encPattern.MatchString(strings.TrimSpace(value)) {
+		return value, nil
+	}
+	if self.key == nil {
+		if self.keyFile == "" {
+			return "", fmt.Errorf("config has encrypted value but no secret key file, set %s", SecretKeyFileEnv)
+		}
+		self.key, err = LoadSecretKey(self.keyFile)
+		if err != nil {
+			return "", err
+		}
+	}
+	return Decrypt(self.key, value)
+}
+
+// resolveSettings resolves every string in settings in place, returns whether
+// anything changed.
+func (self *secretResolver) resolveSettings(settings map[string]interface{}, prefix string) (bool, error) {
+	changed := false
+	for k, v := range settings {
+		switch value := v.(type) {
+		case string:
+			resolved, err := self.resolve(value)
+			if err != nil {
+				return false, errors.WithMessagef(err, "resolve config %s%s", prefix, k)
+			}
+			if resolved != value {
+				settings[k] = resolved
+				changed = true
+			}
+		case []interface{}:
+			for i, item := range value {
+				s, ok := item.(string)
+				if !ok {
+					continue
+				}
+				resolved, err := self.resolve(s)
+				if err != nil {
+					return false, errors.WithMessagef(err, "resolve config %s%s.%d", prefix, k, i)
+				}
+				if resolved != s {
+					value[i] = resolved
+					changed = true
+				}
+			}
+		default:
+			m, ok := toStringMap(v)
+			if !ok {
+				continue
+			}
+			c, err := self.resolveSettings(m, prefix+k+".")
+			if err != nil {
+				return false, err
+			}
+			if c {
+				settings[k] = m
+				changed = true
+			}
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,80 @@
+package conf_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.yym.plus/zeus/pkg/conf"
+)
+
+func TestSecrets(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	secretFile := filepath.Join(dir, "db_pass")
+	configFile := filepath.Join(dir, "app.yml")
+
+	key, err := conf.GenerateSecretKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(secretFile, []byte("file-pass\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	aesKey, err := conf.LoadSecretKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := conf.Encrypt(aesKey, "enc-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("ZEUS_TEST_PASS", "env-pass")
+	defer os.Unsetenv("ZEUS_TEST_PASS")
+
+	content := fmt.Sprintf(`db:
+  uri: root:${secret:file:%s}@tcp(127.0.0.1)/app
+  pass: ${env:ZEUS_TEST_PASS}
+redis:
+  password: %s
+  port: 6379
+`, secretFile, encrypted)
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := conf.NewViperFromSource(&conf.Source{Type: "file", URI: configFile, SecretKeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.GetString("db.uri") != "root:file-pass@tcp(127.0.0.1)/app" ||
+		v.GetString("db.pass") != "env-pass" ||
+		v.GetString("redis.password") != "enc-pass" ||
+		v.GetInt("redis.port") != 6379 {
+		t.Fatalf("unexpected config %v", v.AllSettings())
+	}
+	if v.ConfigFileUsed() != configFile {
+		t.Fatalf("resolved viper lost the config file, got %q", v.ConfigFileUsed())
+	}
+
+	// env still overrides a resolved value
+	os.Setenv("ZEUS_DB_PASS", "override")
+	defer os.Unsetenv("ZEUS_DB_PASS")
+	v, err = conf.NewViperFromSource(&conf.Source{Type: "file", URI: configFile, SecretKeyFile: keyFile}, conf.WithEnv("zeus"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.GetString("db.pass") != "override" || v.GetString("redis.password") != "enc-pass" {
+		t.Fatalf("unexpected config %v", v.AllSettings())
+	}
+
+	_, err = conf.NewViperFromSource(&conf.Source{Type: "file", URI: configFile})
+	if err == nil {
+		t.Fatal("expect error without secret key")
+	}
+}
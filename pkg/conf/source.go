@@ -1,19 +1,71 @@
 package conf
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
+// Source describes where a config is loaded from. Type is "file", "nacos",
+// "etcd", "consul", "http" or "layered", for layered the Layers are merged in
+// order and may also be of type "env" with URI as the variable prefix, or "flag".
+// PollInterval is how often an http source is checked for changes. CacheDir
+// keeps the last fetched remote config as a fallback when the remote is down.
+//
+// The dataIDs of a nacos source are merged into the config of the viper, which
+// viper's own remote watching doesn't update, use a Watcher to follow changes.
+//
+// The URI and every string value may reference secrets as ${env:NAME} or
+// ${secret:file:PATH}, values of the form ENC(...) are decrypted with the AES
+// key in SecretKeyFile, or the file named by ZEUS_SECRET_KEY_FILE.
+//
+// AutomaticEnv, EnvPrefix, EnvKeyReplacer and FlagSet bind environment variables
+// and flags on top of the loaded config whatever the type is.
 type Source struct {
-	Type        string
-	ContentType string
-	URI         string
+	Type           string
+	ContentType    string
+	URI            string
+	Name           string
+	Optional       bool
+	Layers         []*Source
+	PollInterval   time.Duration
+	CacheDir       string
+	SecretKeyFile  string
+	AutomaticEnv   bool
+	EnvPrefix      string
+	EnvKeyReplacer []string
+	FlagSet        *pflag.FlagSet `mapstructure:"-"`
 }
 
-func NewViperFromFile(p string, dirs ...string) (*viper.Viper, error) {
+// Option modifies a Source before it is loaded.
+type Option func(s *Source)
+
+// WithEnv makes every key overridable by environment variables, replacer is
+// old/new pairs applied to the key, "." to "_" if empty.
+func WithEnv(prefix string, replacer ...string) Option {
+	return func(s *Source) {
+		s.AutomaticEnv = true
+		s.EnvPrefix = prefix
+		if len(replacer) > 0 {
+			s.EnvKeyReplacer = replacer
+		}
+	}
+}
+
+// WithFlagSet makes every key overridable by the flag of the same name.
+func WithFlagSet(flags *pflag.FlagSet) Option {
+	return func(s *Source) {
+		s.FlagSet = flags
+	}
+}
+
+// LoadSourceFile reads a Source from the config file named p in dirs.
+func LoadSourceFile(p string, dirs ...string) (*Source, error) {
 	v := viper.New()
 	for _, dir := range dirs {
 		v.AddConfigPath(dir)
@@ -28,10 +80,40 @@ func NewViperFromFile(p string, dirs ...string) (*viper.Viper, error) {
 	if err != nil {
 		return nil, errors.WithMessage(err, "parse source file failed")
 	}
-	return NewViperFromSource(&source)
+	return &source, nil
+}
+
+func NewViperFromFile(p string, dirs ...string) (*viper.Viper, error) {
+	source, err := LoadSourceFile(p, dirs...)
+	if err != nil {
+		return nil, err
+	}
+	return NewViperFromSource(source)
+}
+
+func NewViperFromSource(s *Source, opts ...Option) (*viper.Viper, error) {
+	s = s.with(opts...)
+	v, err := newViper(s)
+	if err != nil {
+		return nil, err
+	}
+	err = s.resolveSecrets(v)
+	if err != nil {
+		return nil, err
+	}
+	err = s.bind(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
 }
 
-func NewViperFromSource(s *Source) (*viper.Viper, error) {
+// newViper loads the source without env and flag bindings.
+func newViper(s *Source) (*viper.Viper, error) {
+	s, err := s.resolveURI()
+	if err != nil {
+		return nil, err
+	}
 	v := viper.New()
 	v.SetConfigType(s.ContentType)
 	switch s.Type {
@@ -42,14 +124,131 @@ func NewViperFromSource(s *Source) (*viper.Viper, error) {
 			return nil, err
 		}
 	case "nacos":
-		MakeVipperSupportNacos()
-		v.AddRemoteProvider("nacos", s.URI, "")
-		err := v.ReadRemoteConfig()
+		cm, err := NewNacosBackend([]string{s.URI})
 		if err != nil {
 			return nil, err
 		}
+		err = mergeNacos(v, s, cm)
+		if err != nil {
+			return nil, err
+		}
+	case "etcd", "consul", "http":
+		store, key, err := newRemoteBackend(s)
+		if err != nil {
+			return nil, err
+		}
+		data, err := s.fetch(store, key)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "get %s config", s.Type)
+		}
+		v.SetConfigType(remoteContentType(s))
+		err = v.ReadConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.WithMessagef(err, "parse %s config", s.Type)
+		}
+	case "layered":
+		l, err := newLayered(s)
+		if err != nil {
+			return nil, err
+		}
+		return l.Viper, nil
 	default:
 		return nil, fmt.Errorf("config source type invalid")
 	}
 	return v, nil
 }
+
+// resolveURI returns a copy of the source whose URI has its secret references resolved.
+func (self *Source) resolveURI() (*Source, error) {
+	uri, err := self.secretResolver().resolve(self.URI)
+	if err != nil {
+		return nil, errors.WithMessage(err, "resolve config source uri")
+	}
+	if uri == self.URI {
+		return self, nil
+	}
+	s := *self
+	s.URI = uri
+	return &s, nil
+}
+
+// resolveSecrets resolves the secret references of the loaded config in place,
+// so the config file, type and remote providers of v are kept. The resolved
+// values are merged into the config rather than Set, which would override env
+// and flags.
+func (self *Source) resolveSecrets(v *viper.Viper) error {
+	settings := v.AllSettings()
+	changed, err := self.secretResolver().resolveSettings(settings, "")
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	return v.MergeConfigMap(settings)
+}
+
+func (self *Source) with(opts ...Option) *Source {
+	if len(opts) == 0 {
+		return self
+	}
+	s := *self
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return &s
+}
+
+func (self *Source) envEnabled() bool {
+	return self.AutomaticEnv || self.EnvPrefix != ""
+}
+
+func (self *Source) envKeyReplacer() *strings.Replacer {
+	if len(self.EnvKeyReplacer) == 0 {
+		return strings.NewReplacer(".", "_")
+	}
+	return strings.NewReplacer(self.EnvKeyReplacer...)
+}
+
+// envName returns the environment variable of key as viper's AutomaticEnv looks up.
+func (self *Source) envName(key string) string {
+	name := strings.ToUpper(self.envKeyReplacer().Replace(key))
+	if self.EnvPrefix != "" {
+		name = strings.ToUpper(self.EnvPrefix) + "_" + name
+	}
+	return name
+}
+
+func (self *Source) bind(v *viper.Viper) error {
+	if len(self.EnvKeyReplacer)%2 != 0 {
+		return fmt.Errorf("config env key replacer must be old/new pairs")
+	}
+	if self.envEnabled() {
+		v.SetEnvPrefix(self.EnvPrefix)
+		v.SetEnvKeyReplacer(self.envKeyReplacer())
+		v.AutomaticEnv()
+	}
+	if self.FlagSet != nil {
+		err := v.BindPFlags(self.FlagSet)
+		if err != nil {
+			return errors.WithMessage(err, "bind flags")
+		}
+	}
+	return nil
+}
+
+// mergeNacos reads every dataID of the backend and merges them in order, so later
+// dataIDs override the keys of earlier ones.
+func mergeNacos(v *viper.Viper, s *Source, cm *NacosBackend) error {
+	for _, dataID := range cm.DataIDs() {
+		data, err := s.fetch(cm, dataID)
+		if err != nil {
+			return errors.WithMessagef(err, "get nacos config %s", dataID)
+		}
+		err = v.MergeConfig(bytes.NewReader(data))
+		if err != nil {
+			return errors.WithMessagef(err, "parse nacos config %s", dataID)
+		}
+	}
+	return nil
+}
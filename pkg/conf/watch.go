@@ -0,0 +1,183 @@
+package conf
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"go.yym.plus/zeus/pkg/log"
+)
+
+// Watcher holds the viper loaded from a Source and swaps it for a freshly
+// loaded one whenever the source changes.
+type Watcher struct {
+	source    *Source
+	current   atomic.Value
+	lock      sync.Mutex
+	listeners []func(v *viper.Viper)
+	quit      chan bool
+	stopOnce  sync.Once
+}
+
+func NewWatcher(s *Source, opts ...Option) (*Watcher, error) {
+	s = s.with(opts...)
+	v, err := NewViperFromSource(s)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		source: s,
+		quit:   make(chan bool),
+	}
+	w.current.Store(v)
+	return w, nil
+}
+
+// Viper returns the latest loaded viper, it must not be modified.
+func (self *Watcher) Viper() *viper.Viper {
+	return self.current.Load().(*viper.Viper)
+}
+
+// OnChange registers f to be called with the new viper after every reload.
+func (self *Watcher) OnChange(f func(v *viper.Viper)) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.listeners = append(self.listeners, f)
+}
+
+func (self *Watcher) Start() error {
+	if self.source.Type != "layered" {
+		return self.watch(self.source)
+	}
+	// env and flag layers never change while running
+	for _, layer := range self.source.Layers {
+		if layer.Type == "env" || layer.Type == "flag" {
+			continue
+		}
+		err := self.watch(layer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *Watcher) watch(s *Source) error {
+	switch s.Type {
+	case "file":
+		return self.watchFile(s.URI)
+	case "nacos", "etcd", "consul", "http":
+		return self.watchRemote(s)
+	default:
+		return fmt.Errorf("config source type %s not support watch", s.Type)
+	}
+}
+
+func (self *Watcher) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.quit)
+	})
+}
+
+// reload loads the whole source again, a change of one layer may be overridden
+// by another.
+func (self *Watcher) reload() {
+	v, err := NewViperFromSource(self.source)
+	if err != nil {
+		log.WithError(err).Errorw("reload config error", "type", self.source.Type)
+		return
+	}
+	self.swap(v)
+}
+
+func (self *Watcher) swap(v *viper.Viper) {
+	self.current.Store(v)
+	self.lock.Lock()
+	listeners := append([]func(v *viper.Viper){}, self.listeners...)
+	self.lock.Unlock()
+	for _, listener := range listeners {
+		listener(v)
+	}
+}
+
+func (self *Watcher) watchFile(path string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.WithMessage(err, "create file watcher")
+	}
+	configFile := filepath.Clean(path)
+	realConfigFile, _ := filepath.EvalSymlinks(configFile)
+	err = watcher.Add(filepath.Dir(configFile))
+	if err != nil {
+		watcher.Close()
+		return errors.WithMessage(err, "watch config dir")
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-self.quit:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// k8s ConfigMap replaces the symlink target instead of writing the file
+				currentConfigFile, _ := filepath.EvalSymlinks(configFile)
+				if (filepath.Clean(event.Name) == configFile && event.Op&(fsnotify.Write|fsnotify.Create) != 0) ||
+					(currentConfigFile != "" && currentConfigFile != realConfigFile) {
+					realConfigFile = currentConfigFile
+					self.reload()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.WithError(err).Errorw("watch config file error", "file", configFile)
+			}
+		}
+	}()
+	return nil
+}
+
+func (self *Watcher) watchRemote(s *Source) error {
+	s, err := s.resolveURI()
+	if err != nil {
+		return err
+	}
+	store, key, err := newRemoteBackend(s)
+	if err != nil {
+		return err
+	}
+	if httpStore, ok := store.(*HTTPBackend); ok {
+		// a fresh backend has no ETag, seed it so the first poll isn't a change
+		_, err = httpStore.Get(key)
+		if err != nil {
+			log.WithError(err).Warnw("seed http config error", "type", s.Type)
+		}
+	}
+	stop := make(chan bool)
+	respChan := store.Watch(key, stop)
+	go func() {
+		defer close(stop)
+		for {
+			select {
+			case <-self.quit:
+				return
+			case resp := <-respChan:
+				if resp.Error != nil {
+					log.WithError(resp.Error).Errorw("watch remote config error", "type", s.Type)
+					continue
+				}
+				// the changed part may be one of several merged dataIDs, reload them all
+				self.reload()
+			}
+		}
+	}()
+	return nil
+}
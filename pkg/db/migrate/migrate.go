@@ -0,0 +1,547 @@
+// Package migrate applies versioned schema migrations to an engine from
+// sql.NewEngine. Migrations are Go funcs or .sql files named like
+//
+//	0001_create_users.up.sql
+//	0001_create_users.down.sql
+//
+// The statements of a .sql file are split on semicolons outside of quotes and
+// comments and executed one by one, so MySQL DSNs don't need multiStatements.
+// Bodies of procedures or triggers, which contain semicolons, belong in Go
+// migrations.
+//
+// Applied migrations are recorded with their checksum in zeus_migrations, and a
+// row in zeus_migration_lock keeps concurrent migrators, such as the pods of a
+// rolling deploy, from racing. The holder refreshes the row while migrating, a
+// row not refreshed for the stale lock duration is left by a crashed migrator
+// and taken over. Each migration runs in a transaction with its record, which
+// protects nothing on MySQL where DDL commits implicitly.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
+
+	"go.yym.plus/zeus/pkg/db/sql"
+	"go.yym.plus/zeus/pkg/log"
+)
+
+// Migration is one schema change, by Go funcs or by sql.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(s *sql.Session) error
+	Down    func(s *sql.Session) error
+	UpSQL   string
+	DownSQL string
+}
+
+// Status is the state of a migration, applied if AppliedAt is set. Modified
+// migrations were changed after being applied, Missing ones were applied but
+// are not known anymore.
+type Status struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+	Modified  bool
+	Missing   bool
+}
+
+// Migrator applies the migrations added to it to an engine.
+type Migrator struct {
+	engine       *xorm.Engine
+	migrations   map[int64]*Migration
+	owner        string
+	lockTimeout  time.Duration
+	lockInterval time.Duration
+	staleLock    time.Duration
+}
+
+// Option configures a Migrator.
+type Option func(m *Migrator)
+
+type record struct {
+	Version   int64     `xorm:"'version' pk"`
+	Name      string    `xorm:"'name' varchar(255)"`
+	Checksum  string    `xorm:"'checksum' varchar(64)"`
+	AppliedAt time.Time `xorm:"'applied_at'"`
+}
+
+func (record) TableName() string {
+	return "zeus_migrations"
+}
+
+type lock struct {
+	Id       int64     `xorm:"'id' pk"`
+	Owner    string    `xorm:"'owner' varchar(255)"`
+	LockedAt time.Time `xorm:"'locked_at'"`
+}
+
+func (lock) TableName() string {
+	return "zeus_migration_lock"
+}
+
+var sqlFileRe = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// WithLockTimeout sets how long to wait for another migrator, 1m by default.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(m *Migrator) {
+		m.lockTimeout = timeout
+	}
+}
+
+// WithStaleLock sets how long after its last refresh a lock is taken over from a
+// crashed migrator, 10m by default, 0 to wait for an unlock instead.
+func WithStaleLock(stale time.Duration) Option {
+	return func(m *Migrator) {
+		m.staleLock = stale
+	}
+}
+
+// New returns a migrator of engine without migrations.
+func New(engine *xorm.Engine, opts ...Option) *Migrator {
+	hostname, _ := os.Hostname()
+	m := &Migrator{
+		engine:       engine,
+		migrations:   map[int64]*Migration{},
+		owner:        fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		lockTimeout:  time.Minute,
+		lockInterval: time.Second,
+		staleLock:    10 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Add adds migrations, each needs a unique positive version and Up or UpSQL.
+func (self *Migrator) Add(migrations ...*Migration) error {
+	for _, migration := range migrations {
+		if migration.Version <= 0 {
+			return errors.Errorf("migration %s version must be positive", migration.Name)
+		}
+		if migration.Up == nil && migration.UpSQL == "" {
+			return errors.Errorf("migration %d has no up", migration.Version)
+		}
+		if _, ok := self.migrations[migration.Version]; ok {
+			return errors.Errorf("migration %d duplicated", migration.Version)
+		}
+		self.migrations[migration.Version] = migration
+	}
+	return nil
+}
+
+// AddSQL adds the migrations of the .sql files in dir of fs, such as http.Dir
+// or packed files. The down file of a migration is optional.
+func (self *Migrator) AddSQL(fs http.FileSystem, dir string) error {
+	d, err := fs.Open(dir)
+	if err != nil {
+		return errors.WithMessage(err, "open migrations dir")
+	}
+	defer d.Close()
+	infos, err := d.Readdir(-1)
+	if err != nil {
+		return errors.WithMessage(err, "read migrations dir")
+	}
+	migrations := map[int64]*Migration{}
+	for _, info := range infos {
+		match := sqlFileRe.FindStringSubmatch(info.Name())
+		if info.IsDir() || match == nil {
+			continue
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		migration, ok := migrations[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			migrations[version] = migration
+		} else if migration.Name != match[2] {
+			return errors.Errorf("migration %d named both %s and %s", version, migration.Name, match[2])
+		}
+		content, err := readFile(fs, path.Join(dir, info.Name()))
+		if err != nil {
+			return err
+		}
+		if match[3] == "up" {
+			migration.UpSQL = content
+		} else {
+			migration.DownSQL = content
+		}
+	}
+	for _, migration := range migrations {
+		err = self.Add(migration)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Up applies all pending migrations in version order and returns them, stopping
+// at the first failure.
+func (self *Migrator) Up(ctx context.Context) ([]*Migration, error) {
+	return self.UpTo(ctx, 0)
+}
+
+// UpTo applies the pending migrations up to version, all if version is 0.
+func (self *Migrator) UpTo(ctx context.Context, version int64) (applied []*Migration, err error) {
+	err = self.locked(ctx, func(records map[int64]*record) error {
+		for _, migration := range self.sorted() {
+			if version > 0 && migration.Version > version {
+				break
+			}
+			if _, ok := records[migration.Version]; ok {
+				continue
+			}
+			err := self.apply(ctx, migration, true)
+			if err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down rolls back the last steps applied migrations and returns them.
+func (self *Migrator) Down(ctx context.Context, steps int) (reverted []*Migration, err error) {
+	err = self.locked(ctx, func(records map[int64]*record) error {
+		versions := make([]int64, 0, len(records))
+		for version := range records {
+			versions = append(versions, version)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+		for i := 0; i < steps && i < len(versions); i++ {
+			migration, ok := self.migrations[versions[i]]
+			if !ok {
+				return errors.Errorf("migration %d applied but unknown, can't roll back", versions[i])
+			}
+			if migration.Down == nil && migration.DownSQL == "" {
+				return errors.Errorf("migration %d has no down", migration.Version)
+			}
+			err := self.apply(ctx, migration, false)
+			if err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status returns the status of known and applied migrations by version.
+func (self *Migrator) Status(ctx context.Context) ([]*Status, error) {
+	err := self.sync()
+	if err != nil {
+		return nil, err
+	}
+	records, err := self.records(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := []*Status{}
+	for _, migration := range self.sorted() {
+		status := &Status{Version: migration.Version, Name: migration.Name}
+		if r, ok := records[migration.Version]; ok {
+			appliedAt := r.AppliedAt
+			status.AppliedAt = &appliedAt
+			status.Modified = r.Checksum != migration.checksum()
+		}
+		statuses = append(statuses, status)
+	}
+	for version, r := range records {
+		if _, ok := self.migrations[version]; !ok {
+			appliedAt := r.AppliedAt
+			statuses = append(statuses, &Status{Version: version, Name: r.Name, AppliedAt: &appliedAt, Missing: true})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// Unlock releases the lock left by a migrator that crashed while migrating.
+func (self *Migrator) Unlock(ctx context.Context) error {
+	err := self.sync()
+	if err != nil {
+		return err
+	}
+	_, err = self.engine.Context(ctx).Where("id = ?", 1).Delete(&lock{})
+	return errors.WithMessage(err, "release migration lock")
+}
+
+func (self *Migrator) sync() error {
+	err := self.engine.Sync2(&record{}, &lock{})
+	return errors.WithMessage(err, "sync migration tables")
+}
+
+func (self *Migrator) sorted() []*Migration {
+	migrations := make([]*Migration, 0, len(self.migrations))
+	for _, migration := range self.migrations {
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations
+}
+
+func (self *Migrator) records(ctx context.Context) (map[int64]*record, error) {
+	rows := []*record{}
+	err := self.engine.Context(ctx).Find(&rows)
+	if err != nil {
+		return nil, errors.WithMessage(err, "load applied migrations")
+	}
+	records := map[int64]*record{}
+	for _, r := range rows {
+		records[r.Version] = r
+	}
+	return records, nil
+}
+
+// locked runs f holding the migration lock, with the applied migrations after
+// refusing to run if an applied migration was modified.
+func (self *Migrator) locked(ctx context.Context, f func(records map[int64]*record) error) error {
+	err := self.sync()
+	if err != nil {
+		return err
+	}
+	err = self.lock(ctx)
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go self.refreshLock(stop, done)
+	defer func() {
+		close(stop)
+		<-done
+		_, err := self.engine.Where("id = ? AND owner = ?", 1, self.owner).Delete(&lock{})
+		if err != nil {
+			log.WithError(err).Errorw("release migration lock failed, run unlock", "owner", self.owner)
+		}
+	}()
+	records, err := self.records(ctx)
+	if err != nil {
+		return err
+	}
+	for version, r := range records {
+		if migration, ok := self.migrations[version]; ok && r.Checksum != migration.checksum() {
+			return errors.Errorf("migration %d modified after being applied", version)
+		}
+	}
+	return f(records)
+}
+
+func (self *Migrator) lock(ctx context.Context) error {
+	// the timeout bounds the wait, not the queries, so the holder is known
+	deadline := time.Now().Add(self.lockTimeout)
+	for {
+		_, err := self.engine.Context(ctx).Insert(&lock{Id: 1, Owner: self.owner, LockedAt: time.Now()})
+		if err == nil {
+			return nil
+		}
+		holder := &lock{}
+		has, gerr := self.engine.Context(ctx).ID(1).Get(holder)
+		if gerr != nil {
+			return errors.WithMessage(gerr, "read migration lock")
+		}
+		if !has {
+			// released since the insert, unless the insert failed otherwise
+			if time.Now().After(deadline) {
+				return errors.WithMessage(err, "acquire migration lock")
+			}
+			continue
+		}
+		if self.staleLock > 0 && time.Since(holder.LockedAt) > self.staleLock {
+			// only the stale row, unless another migrator took it over meanwhile
+			affected, err := self.engine.Context(ctx).Where("id = ? AND owner = ? AND locked_at < ?",
+				1, holder.Owner, time.Now().Add(-self.staleLock)).Delete(&lock{})
+			if err != nil {
+				return errors.WithMessage(err, "take over stale migration lock")
+			}
+			if affected > 0 {
+				log.Warnw("took over stale migration lock", "owner", holder.Owner, "lockedAt", holder.LockedAt)
+				continue
+			}
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return errors.Errorf("migration locked by %s since %s", holder.Owner, holder.LockedAt.Format(time.RFC3339))
+		}
+		if wait > self.lockInterval {
+			wait = self.lockInterval
+		}
+		log.Infow("waiting for migration lock", "owner", holder.Owner, "lockedAt", holder.LockedAt)
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("migration locked by %s since %s", holder.Owner, holder.LockedAt.Format(time.RFC3339))
+		case <-time.After(wait):
+		}
+	}
+}
+
+// refreshLock keeps the lock from going stale until stop is closed.
+func (self *Migrator) refreshLock(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	if self.staleLock <= 0 {
+		return
+	}
+	ticker := time.NewTicker(self.staleLock / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		_, err := self.engine.Where("id = ? AND owner = ?", 1, self.owner).Cols("locked_at").Update(&lock{LockedAt: time.Now()})
+		if err != nil {
+			log.WithError(err).Warnw("refresh migration lock failed", "owner", self.owner)
+		}
+	}
+}
+
+func (self *Migrator) apply(ctx context.Context, migration *Migration, up bool) error {
+	direction := "up"
+	if !up {
+		direction = "down"
+	}
+	start := time.Now()
+	err := sql.WithTx(ctx, self.engine, func(s *sql.Session) error {
+		f, query := migration.Up, migration.UpSQL
+		if !up {
+			f, query = migration.Down, migration.DownSQL
+		}
+		if f != nil {
+			err := f(s)
+			if err != nil {
+				return err
+			}
+		} else {
+			for _, statement := range splitStatements(query, self.engine.Dialect().URI().DBType) {
+				_, err := s.Exec(statement)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if up {
+			_, err := s.Insert(&record{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				Checksum:  migration.checksum(),
+				AppliedAt: time.Now(),
+			})
+			return err
+		}
+		_, err := s.Where("version = ?", migration.Version).Delete(&record{})
+		return err
+	}, sql.WithTxRetries(0))
+	if err != nil {
+		return errors.WithMessagef(err, "migration %d %s %s", migration.Version, migration.Name, direction)
+	}
+	log.Infow("migration applied", "version", migration.Version, "name", migration.Name,
+		"direction", direction, "elapsed", time.Since(start))
+	return nil
+}
+
+// checksum identifies the content of a migration, Go migrations only by name.
+func (self *Migration) checksum() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n%s", self.Version, self.Name, self.UpSQL)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// splitStatements splits query on the semicolons outside of quoted strings,
+// identifiers, dollar quoted bodies and comments, dropping statements which are
+// empty or only comments. '#' starts a comment on MySQL only, it is an
+// operator elsewhere.
+func splitStatements(query string, dbType schemas.DBType) []string {
+	statements := []string{}
+	start, content := 0, false
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			for i++; i < len(query) && query[i] != c; i++ {
+				if query[i] == '\\' {
+					i++
+				}
+			}
+			content = true
+		case c == '-' && strings.HasPrefix(query[i:], "--"), c == '#' && dbType == schemas.MYSQL:
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+		case c == '$' && dollarTag(query[i:]) != "":
+			tag := dollarTag(query[i:])
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += len(tag) + end + len(tag) - 1
+			}
+			content = true
+		case c == ';':
+			if content {
+				statements = append(statements, strings.TrimSpace(query[start:i]))
+			}
+			start, content = i+1, false
+		case c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			content = true
+		}
+	}
+	if content {
+		statements = append(statements, strings.TrimSpace(query[start:]))
+	}
+	return statements
+}
+
+// dollarTag returns the $$ or $tag$ opening a postgres dollar quoted string at the
+// start of query, or empty.
+func dollarTag(query string) string {
+	for i := 1; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '$':
+			return query[:i+1]
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 1 && c >= '0' && c <= '9':
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+func readFile(fs http.FileSystem, name string) (string, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", errors.WithMessage(err, "open migration")
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", errors.WithMessagef(err, "read migration %s", name)
+	}
+	return string(content), nil
+}
@@ -0,0 +1,215 @@
+package migrate
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"xorm.io/xorm/schemas"
+
+	"go.yym.plus/zeus/pkg/db/sql"
+)
+
+func newTestMigrator(t *testing.T, file, dir string) *Migrator {
+	engine, err := sql.NewEngine(&sql.EngineConfig{
+		Type:     "sqlite3",
+		Uri:      file + "?_busy_timeout=5000",
+		LogLevel: "off",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	m := New(engine, WithLockTimeout(time.Second))
+	m.lockInterval = 10 * time.Millisecond
+	err = m.AddSQL(http.Dir(dir), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Add(&Migration{
+		Version: 3,
+		Name:    "seed_users",
+		Up: func(s *sql.Session) error {
+			_, err := s.Exec("INSERT INTO users (name, email) VALUES ('admin', 'admin@example.com')")
+			return err
+		},
+		Down: func(s *sql.Session) error {
+			_, err := s.Exec("DELETE FROM users WHERE name = 'admin'")
+			return err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func writeMigrations(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func versions(migrations []*Migration) []int64 {
+	result := []int64{}
+	for _, migration := range migrations {
+		result = append(result, migration.Version)
+	}
+	return result
+}
+
+func TestMigrate(t *testing.T) {
+	dir := writeMigrations(t, map[string]string{
+		"0001_create_users.up.sql":   "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, email TEXT);",
+		"0001_create_users.down.sql": "DROP TABLE users;",
+		"0002_index_email.up.sql":    "CREATE UNIQUE INDEX users_email ON users (email);",
+		"0002_index_email.down.sql":  "DROP INDEX users_email;",
+		"README.md":                  "ignored",
+	})
+	file := filepath.Join(t.TempDir(), "app.db")
+	ctx := context.Background()
+
+	// concurrent migrators apply each migration once
+	var wg sync.WaitGroup
+	applied := make([][]*Migration, 3)
+	for i := range applied {
+		m := newTestMigrator(t, file, dir)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			applied[i], err = m.Up(ctx)
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	total := 0
+	for _, migrations := range applied {
+		total += len(migrations)
+	}
+	if total != 3 {
+		t.Fatalf("%d migrations applied", total)
+	}
+
+	m := newTestMigrator(t, file, dir)
+	count, err := m.engine.Table("users").Where("email = ?", "admin@example.com").Count()
+	if err != nil || count != 1 {
+		t.Fatalf("seeded %d users, err %v", count, err)
+	}
+	reverted, err := m.Down(ctx, 2)
+	if err != nil || len(reverted) != 2 || reverted[0].Version != 3 || reverted[1].Version != 2 {
+		t.Fatalf("unexpected down %v, err %v", versions(reverted), err)
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil || len(statuses) != 3 || statuses[0].AppliedAt == nil || statuses[1].AppliedAt != nil {
+		t.Fatalf("unexpected status %v", err)
+	}
+	applied[0], err = m.UpTo(ctx, 2)
+	if err != nil || len(applied[0]) != 1 || applied[0][0].Version != 2 {
+		t.Fatalf("unexpected up to 2 %v, err %v", versions(applied[0]), err)
+	}
+
+	// an applied migration changed
+	modified := writeMigrations(t, map[string]string{
+		"0001_create_users.up.sql": "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT NOT NULL, email TEXT);",
+		"0002_index_email.up.sql":  "CREATE UNIQUE INDEX users_email ON users (email);",
+	})
+	m = newTestMigrator(t, file, modified)
+	_, err = m.Up(ctx)
+	if err == nil || !strings.Contains(err.Error(), "modified") {
+		t.Fatalf("modified migration not refused, err %v", err)
+	}
+	statuses, err = m.Status(ctx)
+	if err != nil || !statuses[0].Modified || statuses[1].Modified {
+		t.Fatalf("modified migration not reported, err %v", err)
+	}
+
+	// a migration unknown to this migrator
+	m = newTestMigrator(t, file, writeMigrations(t, nil))
+	statuses, err = m.Status(ctx)
+	if err != nil || len(statuses) != 3 || !statuses[0].Missing || statuses[2].AppliedAt != nil {
+		t.Fatalf("missing migrations not reported, err %v", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir := writeMigrations(t, map[string]string{
+		"0001_create_users.up.sql": "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, email TEXT);",
+	})
+	file := filepath.Join(t.TempDir(), "app.db")
+	ctx := context.Background()
+
+	m := newTestMigrator(t, file, dir)
+	err := m.sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// left by a crashed migrator
+	_, err = m.engine.Insert(&lock{Id: 1, Owner: "crashed", LockedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.lockTimeout = 50 * time.Millisecond
+	_, err = m.Up(ctx)
+	if err == nil || !strings.Contains(err.Error(), "locked by crashed") {
+		t.Fatalf("lock not respected, err %v", err)
+	}
+	err = m.Unlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := m.Up(ctx)
+	if err != nil || len(applied) != 2 {
+		t.Fatalf("unexpected up %v, err %v", versions(applied), err)
+	}
+	has, err := m.engine.Exist(&lock{})
+	if err != nil || has {
+		t.Fatalf("lock not released, err %v", err)
+	}
+
+	// a stale lock is taken over
+	_, err = m.engine.Insert(&lock{Id: 1, Owner: "crashed", LockedAt: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.staleLock = time.Minute
+	_, err = m.Down(ctx, 1)
+	if err != nil {
+		t.Fatalf("stale lock not taken over, err %v", err)
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	query := `-- users; the first table
+CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT DEFAULT 'a;b', "x;y" TEXT);
+/* seed; */ INSERT INTO users (name) VALUES ('it''s; \'quoted\'');
+CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql;
+SELECT $1;
+;
+# mysql comment;
+-- trailing comment`
+	statements := splitStatements(query, schemas.MYSQL)
+	if len(statements) != 4 {
+		t.Fatalf("unexpected statements %q", statements)
+	}
+	if !strings.HasSuffix(statements[0], `"x;y" TEXT)`) || !strings.HasSuffix(statements[1], `\'quoted\'')`) ||
+		!strings.HasSuffix(statements[2], "LANGUAGE sql") || statements[3] != "SELECT $1" {
+		t.Fatalf("unexpected statements %q", statements)
+	}
+	statements = splitStatements("SELECT 1 # 2; SELECT 2", schemas.POSTGRES)
+	if len(statements) != 2 || statements[0] != "SELECT 1 # 2" {
+		t.Fatalf("unexpected statements %q", statements)
+	}
+}
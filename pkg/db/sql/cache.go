@@ -0,0 +1,249 @@
+package sql
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"reflect"
+	"sync"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	"xorm.io/xorm"
+
+	"go.yym.plus/zeus/pkg/cache/redis"
+	"go.yym.plus/zeus/pkg/log"
+)
+
+// CacheConfig configures the xorm second level cache of entities by primary key
+// and of query ids, kept in redis. Writes through the engine invalidate the
+// cache of the table, writes by others show after TTL.
+type CacheConfig struct {
+	// Enable caches all tables but those disabled in Tables.
+	Enable bool
+	TTL    time.Duration `default:"10m"`
+	Prefix string        `default:"zeus:xorm:"`
+	Redis  redis.Config
+	// Tables enables, disables or sets the TTL of tables by name, the name
+	// without suffix for the shard tables of a Manager.
+	Tables map[string]TableCacheConfig
+}
+
+type TableCacheConfig struct {
+	// Enable overrides CacheConfig.Enable if set.
+	Enable *bool
+	TTL    time.Duration
+}
+
+// RedisCacher is a xorm cacher in redis. Clearing the ids or beans of a table
+// bumps a generation in their keys instead of scanning, the stale keys expire.
+type RedisCacher struct {
+	client *goredis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+var (
+	cacheTypes       sync.Map
+	cacheClients     = map[redis.Config]*goredis.Client{}
+	cacheClientsLock sync.Mutex
+)
+
+// NewRedisCacher returns a cacher whose keys are prefixed with prefix and
+// expire after ttl.
+func NewRedisCacher(client *goredis.Client, prefix string, ttl time.Duration) *RedisCacher {
+	return &RedisCacher{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+// setCacher sets the cachers of engine by config, if any table is cached, with
+// keys prefixed by prefix. tableName returns the name in engine of a table of
+// config.Tables, nil if the same.
+func setCacher(config *CacheConfig, engine *xorm.Engine, prefix string, tableName func(name string) string) {
+	enabled := config.Enable
+	for _, table := range config.Tables {
+		if table.Enable != nil && *table.Enable {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return
+	}
+	client := cacheClient(&config.Redis)
+	cacher := NewRedisCacher(client, prefix, config.TTL)
+	if config.Enable {
+		engine.SetDefaultCacher(cacher)
+	}
+	for name, table := range config.Tables {
+		if tableName != nil {
+			name = tableName(name)
+		}
+		if table.Enable != nil && !*table.Enable {
+			engine.SetCacher(name, nil)
+			continue
+		}
+		if table.Enable == nil && !config.Enable {
+			continue
+		}
+		if table.TTL > 0 {
+			engine.SetCacher(name, NewRedisCacher(client, prefix, table.TTL))
+		} else {
+			engine.SetCacher(name, cacher)
+		}
+	}
+}
+
+// cacheClient returns the redis client of config, shared by the engines of the
+// same config so that engines reopened by a Manager don't add clients. The
+// clients are kept for the life of the process.
+func cacheClient(config *redis.Config) *goredis.Client {
+	cacheClientsLock.Lock()
+	defer cacheClientsLock.Unlock()
+	if client, ok := cacheClients[*config]; ok {
+		return client
+	}
+	client, err := redis.NewRedis(config)
+	if err != nil {
+		log.WithError(err).Warnw("xorm cache redis unreachable, queries hit the db until it is back", "addr", config.Addr)
+	}
+	cacheClients[*config] = client
+	return client
+}
+
+func (self *RedisCacher) GetIds(tableName, sql string) interface{} {
+	data := self.get(self.idsKey(tableName, sql))
+	if data == nil {
+		return nil
+	}
+	return string(data)
+}
+
+func (self *RedisCacher) GetBean(tableName string, id string) interface{} {
+	data := self.get(self.beanKey(tableName, id))
+	if data == nil {
+		return nil
+	}
+	var bean interface{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&bean)
+	if err != nil {
+		// types are registered by PutBean, unknown in a new process until then
+		log.WithError(err).Debugw("xorm cache bean undecodable", "table", tableName, "id", id)
+		return nil
+	}
+	return bean
+}
+
+func (self *RedisCacher) PutIds(tableName, sql string, ids interface{}) {
+	data, ok := ids.(string)
+	if !ok {
+		log.Warnw("xorm cache ids not encoded", "table", tableName, "type", reflect.TypeOf(ids))
+		return
+	}
+	self.set(self.idsKey(tableName, sql), []byte(data))
+}
+
+func (self *RedisCacher) PutBean(tableName string, id string, obj interface{}) {
+	registerCacheType(obj)
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&obj)
+	if err != nil {
+		log.WithError(err).Warnw("xorm cache bean unencodable", "table", tableName, "id", id)
+		return
+	}
+	self.set(self.beanKey(tableName, id), buf.Bytes())
+}
+
+func (self *RedisCacher) DelIds(tableName, sql string) {
+	self.del(self.idsKey(tableName, sql))
+}
+
+func (self *RedisCacher) DelBean(tableName string, id string) {
+	self.del(self.beanKey(tableName, id))
+}
+
+func (self *RedisCacher) ClearIds(tableName string) {
+	self.bump(self.prefix + tableName + ":ids")
+}
+
+func (self *RedisCacher) ClearBeans(tableName string) {
+	self.bump(self.prefix + tableName + ":beans")
+}
+
+func (self *RedisCacher) idsKey(tableName, sql string) string {
+	sum := sha1.Sum([]byte(sql))
+	return self.generationKey(self.prefix+tableName+":ids") + ":" + hex.EncodeToString(sum[:])
+}
+
+func (self *RedisCacher) beanKey(tableName, id string) string {
+	return self.generationKey(self.prefix+tableName+":beans") + ":" + id
+}
+
+// generationKey returns the key of the current generation of base, base:gen:n.
+func (self *RedisCacher) generationKey(base string) string {
+	gen, err := self.client.Get(context.Background(), base+":gen").Result()
+	if err == goredis.Nil {
+		gen = "0"
+	} else if err != nil {
+		log.WithError(err).Warnw("xorm cache generation unreadable", "key", base)
+		gen = "0"
+	}
+	return base + ":" + gen
+}
+
+func (self *RedisCacher) bump(base string) {
+	err := self.client.Incr(context.Background(), base+":gen").Err()
+	if err != nil {
+		log.WithError(err).Errorw("xorm cache not cleared, stale until expired", "key", base)
+	}
+}
+
+func (self *RedisCacher) get(key string) []byte {
+	data, err := self.client.Get(context.Background(), key).Bytes()
+	if err != nil {
+		if err != goredis.Nil {
+			log.WithError(err).Warnw("xorm cache get failed", "key", key)
+		}
+		return nil
+	}
+	return data
+}
+
+func (self *RedisCacher) set(key string, data []byte) {
+	err := self.client.Set(context.Background(), key, data, self.ttl).Err()
+	if err != nil {
+		log.WithError(err).Warnw("xorm cache set failed", "key", key)
+	}
+}
+
+func (self *RedisCacher) del(key string) {
+	err := self.client.Del(context.Background(), key).Err()
+	if err != nil {
+		log.WithError(err).Errorw("xorm cache not deleted, stale until expired", "key", key)
+	}
+}
+
+// registerCacheType registers the type of bean to gob by package path, the
+// default name has only the package name, which may collide.
+func registerCacheType(bean interface{}) {
+	t := reflect.TypeOf(bean)
+	if _, loaded := cacheTypes.LoadOrStore(t, true); loaded {
+		return
+	}
+	elem := t
+	name := ""
+	if elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+		name = "*"
+	}
+	name += elem.PkgPath() + "." + elem.Name()
+	defer func() {
+		// registered by the application already
+		recover()
+	}()
+	gob.RegisterName(name, bean)
+}
@@ -0,0 +1,320 @@
+package sql
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the redis commands of the cacher from memory.
+type fakeRedis struct {
+	lock     sync.Mutex
+	data     map[string]string
+	commands map[string]int
+}
+
+func newFakeRedis(t *testing.T) (*fakeRedis, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	r := &fakeRedis{data: map[string]string{}, commands: map[string]int{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r, listener.Addr().String()
+}
+
+func (self *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		self.lock.Lock()
+		name := strings.ToUpper(args[0])
+		self.commands[name]++
+		var reply string
+		switch name {
+		case "PING":
+			reply = "+PONG\r\n"
+		case "GET":
+			value, ok := self.data[args[1]]
+			if ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case "SET":
+			self.data[args[1]] = args[2]
+			reply = "+OK\r\n"
+		case "DEL":
+			n := 0
+			for _, key := range args[1:] {
+				if _, ok := self.data[key]; ok {
+					delete(self.data, key)
+					n++
+				}
+			}
+			reply = fmt.Sprintf(":%d\r\n", n)
+		case "INCR":
+			n, _ := strconv.Atoi(self.data[args[1]])
+			self.data[args[1]] = strconv.Itoa(n + 1)
+			reply = fmt.Sprintf(":%d\r\n", n+1)
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		self.lock.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line)[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line)[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (self *fakeRedis) count(name string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.commands[name]
+}
+
+type cachedUser struct {
+	Id        int64
+	Name      string
+	CreatedAt time.Time
+}
+
+func TestRedisCacher(t *testing.T) {
+	r, addr := newFakeRedis(t)
+	file := filepath.Join(t.TempDir(), "cache.db")
+	disabled := false
+	config := &EngineConfig{Type: "sqlite3", Uri: file, LogLevel: "off"}
+	config.Cache.Enable = true
+	config.Cache.Redis.Addr = addr
+	config.Cache.Tables = map[string]TableCacheConfig{"group_user": {Enable: &disabled}}
+	engine, err := NewEngine(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	err = engine.Sync2(&cachedUser{}, &groupUser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = engine.Insert(&cachedUser{Name: "cached", CreatedAt: time.Now()}, &groupUser{Name: "uncached"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	get := func(id int64) *cachedUser {
+		user := &cachedUser{}
+		has, err := engine.Context(ctx).ID(id).Get(user)
+		if err != nil || !has {
+			t.Fatalf("user %d not found, err %v", id, err)
+		}
+		return user
+	}
+	get(1)
+	sets := r.count("SET")
+	if sets == 0 {
+		t.Fatal("bean not cached")
+	}
+	// served from the cache even if changed behind the engine
+	_, err = engine.Exec("UPDATE cached_user SET name = 'behind' WHERE id = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := get(1); user.Name != "cached" || user.CreatedAt.IsZero() {
+		t.Fatalf("unexpected cached user %+v", user)
+	}
+
+	// writes through the engine invalidate
+	_, err = engine.Context(ctx).ID(1).Update(&cachedUser{Name: "updated"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := get(1); user.Name != "updated" {
+		t.Fatalf("stale user %s after update", user.Name)
+	}
+	users := []*cachedUser{}
+	err = engine.Context(ctx).Where("name = ?", "updated").Find(&users)
+	if err != nil || len(users) != 1 {
+		t.Fatalf("found %d users, err %v", len(users), err)
+	}
+	_, err = engine.Context(ctx).Insert(&cachedUser{Name: "updated"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users = []*cachedUser{}
+	err = engine.Context(ctx).Where("name = ?", "updated").Find(&users)
+	if err != nil || len(users) != 2 {
+		t.Fatalf("stale query ids after insert, found %d users, err %v", len(users), err)
+	}
+
+	// disabled table
+	sets = r.count("SET")
+	user := &groupUser{}
+	_, err = engine.Context(ctx).ID(1).Get(user)
+	if err != nil || user.Name != "uncached" || r.count("SET") != sets {
+		t.Fatalf("disabled table cached, err %v", err)
+	}
+}
+
+func TestCacheShardTables(t *testing.T) {
+	_, addr := newFakeRedis(t)
+	disabled := false
+	config := &EngineConfig{Type: "sqlite3", Uri: filepath.Join(t.TempDir(), "shard.db"), LogLevel: "off"}
+	config.Cache.Enable = true
+	config.Cache.Redis.Addr = addr
+	config.Cache.Tables = map[string]TableCacheConfig{"shard_order": {Enable: &disabled}}
+	m, err := NewManager(&ManagerConfig{
+		Engines:     map[string]*EngineConfig{"default": config},
+		Shards:      []ShardConfig{{Engine: "default", TableSuffix: "_0"}},
+		ShardTables: []string{"shard_order"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	shard, err := m.Shard(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shard.GetCacher("shard_order_0") != nil || shard.GetCacher("cached_user") == nil {
+		t.Fatal("table cache config not applied to the shard table")
+	}
+	engine, err := m.Engine("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shard.GetCacher("cached_user").(*RedisCacher).client != engine.GetCacher("cached_user").(*RedisCacher).client {
+		t.Fatal("engines of the same config should share the redis client")
+	}
+}
+
+func TestCacheEngineGroup(t *testing.T) {
+	r, addr := newFakeRedis(t)
+	dir := t.TempDir()
+	primary := filepath.Join(dir, "primary.db")
+	replica := filepath.Join(dir, "replica.db")
+	newSqliteEngine(t, primary, "primary")
+	newSqliteEngine(t, replica, "replica")
+	config := &EngineConfig{Type: "sqlite3", Uri: primary, LogLevel: "off", Replicas: []ReplicaConfig{{Uri: replica}}}
+	config.Cache.Enable = true
+	config.Cache.Redis.Addr = addr
+	group, err := NewEngineGroup(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer group.Close()
+	ctx := context.Background()
+
+	// the replica lags behind the primary and must not fill the cache
+	user := &groupUser{}
+	has, err := group.Context(ctx).ID(1).Get(user)
+	if err != nil || !has || user.Name != "replica" || r.count("SET") != 0 {
+		t.Fatalf("replica read %+v cached, err %v", user, err)
+	}
+	user = &groupUser{}
+	has, err = group.Context(WithPrimary(ctx)).ID(1).Get(user)
+	if err != nil || !has || user.Name != "primary" || r.count("SET") == 0 {
+		t.Fatalf("primary read %+v not cached, err %v", user, err)
+	}
+	// the writes of sessions reading from replicas still invalidate
+	_, err = group.Context(ctx).ID(1).Delete(&groupUser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user = &groupUser{}
+	has, err = group.Context(WithPrimary(ctx)).ID(1).Get(user)
+	if err != nil || has {
+		t.Fatalf("deleted user %+v cached, err %v", user, err)
+	}
+}
+
+func TestCacheTenants(t *testing.T) {
+	_, addr := newFakeRedis(t)
+	config := &EngineConfig{Type: "sqlite3", Uri: filepath.Join(t.TempDir(), "tenant_{tenant}.db"), LogLevel: "off"}
+	config.Cache.Enable = true
+	config.Cache.Redis.Addr = addr
+	m, err := NewManager(&ManagerConfig{Tenant: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	ctx := context.Background()
+	tenants := []string{"acme", "globex"}
+	for _, tenant := range tenants {
+		s, err := m.Context(WithTenant(ctx, tenant))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Sync2(&cachedUser{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Insert(&cachedUser{Name: tenant, CreatedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the same id of each tenant is cached apart
+	for i := 0; i < 2; i++ {
+		for _, tenant := range tenants {
+			s, err := m.Context(WithTenant(ctx, tenant))
+			if err != nil {
+				t.Fatal(err)
+			}
+			user := &cachedUser{}
+			has, err := s.ID(1).Get(user)
+			if err != nil || !has || user.Name != tenant {
+				t.Fatalf("tenant %s got user %+v, err %v", tenant, user, err)
+			}
+		}
+	}
+}
@@ -1,11 +1,37 @@
 package sql
 
-import "xorm.io/xorm"
+import (
+	"reflect"
+
+	"xorm.io/builder"
+	"xorm.io/xorm"
+)
 
 type Cond interface {
 	Apply(s *xorm.Session) error
 }
 
+// Where is a WHERE condition, conditions applied to the same session are ANDed.
+type Where struct {
+	cond builder.Cond
+}
+
+// Select limits the columns queried or updated.
+type Select struct {
+	columns []string
+}
+
+type Join struct {
+	operator string
+	table    interface{}
+	on       string
+	args     []interface{}
+}
+
+type Having struct {
+	having string
+}
+
 type Pagination struct {
 	size int32
 	page int32
@@ -41,7 +67,11 @@ func (self *OrderBy) Apply(s *xorm.Session) error {
 }
 
 func (self *Pagination) Apply(s *xorm.Session) error {
-	s.Limit(int(self.size), int(self.size*(self.page-1)))
+	page := self.page
+	if page < 1 {
+		page = 1
+	}
+	s.Limit(int(self.size), int(self.size*(page-1)))
 	return nil
 }
 
@@ -77,3 +107,131 @@ func NewGroupBy(group string) *GroupBy {
 func NewCondEx(f func(s *xorm.Session) error) *CondEx {
 	return &CondEx{f: f}
 }
+
+func (self *Where) Apply(s *xorm.Session) error {
+	s.And(self.cond)
+	return nil
+}
+
+func (self *Select) Apply(s *xorm.Session) error {
+	s.Cols(self.columns...)
+	return nil
+}
+
+func (self *Join) Apply(s *xorm.Session) error {
+	s.Join(self.operator, self.table, self.on, self.args...)
+	return nil
+}
+
+func (self *Having) Apply(s *xorm.Session) error {
+	s.Having(self.having)
+	return nil
+}
+
+// NewEq matches rows whose column equals value.
+func NewEq(column string, value interface{}) *Where {
+	return &Where{cond: builder.Eq{column: value}}
+}
+
+// NewIn matches rows whose column is one of values, a single slice argument is
+// expanded.
+func NewIn(column string, values ...interface{}) *Where {
+	return &Where{cond: builder.In(column, values...)}
+}
+
+// NewBetween matches rows whose column is between low and high, inclusive.
+func NewBetween(column string, low, high interface{}) *Where {
+	return &Where{cond: builder.Between{Col: column, LessVal: low, MoreVal: high}}
+}
+
+// NewLike matches rows whose column contains pattern, or matches it if pattern
+// has a % wildcard.
+func NewLike(column, pattern string) *Where {
+	return &Where{cond: builder.Like{column, pattern}}
+}
+
+func NewIsNull(column string) *Where {
+	return &Where{cond: builder.IsNull{column}}
+}
+
+func NewAnd(conds ...*Where) *Where {
+	return &Where{cond: builder.And(whereConds(conds)...)}
+}
+
+func NewOr(conds ...*Where) *Where {
+	return &Where{cond: builder.Or(whereConds(conds)...)}
+}
+
+func NewNot(cond *Where) *Where {
+	return &Where{cond: builder.Not{cond.cond}}
+}
+
+func NewSelect(columns ...string) *Select {
+	return &Select{columns: columns}
+}
+
+// NewJoin joins table, a name or a bean, with operator such as INNER or LEFT on
+// the condition on.
+func NewJoin(operator string, table interface{}, on string, args ...interface{}) *Join {
+	return &Join{operator: operator, table: table, on: on, args: args}
+}
+
+func NewHaving(having string) *Having {
+	return &Having{having: having}
+}
+
+func whereConds(conds []*Where) []builder.Cond {
+	result := make([]builder.Cond, 0, len(conds))
+	for _, cond := range conds {
+		result = append(result, cond.cond)
+	}
+	return result
+}
+
+// ApplyConds applies conds to s in order.
+func ApplyConds(s *xorm.Session, conds ...Cond) error {
+	for _, cond := range conds {
+		err := cond.Apply(s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find queries the rows matching conds into rowsSlicePtr, the result count is
+// the number of rows found.
+func Find(s *xorm.Session, rowsSlicePtr interface{}, conds ...Cond) *FindResult {
+	err := ApplyConds(s, conds...)
+	if err != nil {
+		return NewFindResult(0, err)
+	}
+	err = s.Find(rowsSlicePtr)
+	if err != nil {
+		return NewFindResult(0, err)
+	}
+	return NewFindResult(int64(reflect.Indirect(reflect.ValueOf(rowsSlicePtr)).Len()), nil)
+}
+
+// Count counts the rows of bean's table matching conds.
+func Count(s *xorm.Session, bean interface{}, conds ...Cond) *FindResult {
+	err := ApplyConds(s, conds...)
+	if err != nil {
+		return NewFindResult(0, err)
+	}
+	return NewFindResult(s.Count(bean))
+}
+
+// Exist checks whether a row of bean's table matches conds, the result count is
+// 1 if one does.
+func Exist(s *xorm.Session, bean interface{}, conds ...Cond) *FindResult {
+	err := ApplyConds(s, conds...)
+	if err != nil {
+		return NewFindResult(0, err)
+	}
+	has, err := s.Exist(bean)
+	if err != nil || !has {
+		return NewFindResult(0, err)
+	}
+	return NewFindResult(1, nil)
+}
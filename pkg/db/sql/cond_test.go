@@ -0,0 +1,86 @@
+package sql
+
+import (
+	"context"
+	"testing"
+)
+
+type condOrder struct {
+	Id     int64
+	UserId int64
+	Amount int
+	Note   string
+}
+
+func TestConds(t *testing.T) {
+	engine := newTxEngine(t)
+	defer engine.Close()
+	err := engine.Sync2(&condOrder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = engine.Insert(&groupUser{Name: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = engine.Insert([]*condOrder{
+		{UserId: 1, Amount: 10, Note: "first order"},
+		{UserId: 1, Amount: 20},
+		{UserId: 2, Amount: 30, Note: "gift"},
+		{UserId: 2, Amount: 40, Note: "second order"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		name  string
+		conds []Cond
+		ids   []int64
+	}{
+		{"eq", []Cond{NewEq("user_id", 2)}, []int64{3, 4}},
+		{"in", []Cond{NewIn("amount", []int{10, 40})}, []int64{1, 4}},
+		{"between", []Cond{NewBetween("amount", 20, 30)}, []int64{2, 3}},
+		{"like", []Cond{NewLike("note", "order")}, []int64{1, 4}},
+		{"or", []Cond{NewOr(NewEq("amount", 10), NewAnd(NewEq("user_id", 2), NewNot(NewLike("note", "gift"))))}, []int64{1, 4}},
+		{"ordered", []Cond{NewEq("user_id", 1), NewOrderBy("amount desc")}, []int64{2, 1}},
+	} {
+		orders := []*condOrder{}
+		result := Find(engine.Context(ctx), &orders, append(c.conds, NewOrderBy("id"))...)
+		if result.HasError() || int(result.Count()) != len(c.ids) {
+			t.Fatalf("%s: found %d, err %v", c.name, result.Count(), result.Error())
+		}
+		for i, order := range orders {
+			if order.Id != c.ids[i] {
+				t.Fatalf("%s: unexpected order %d at %d", c.name, order.Id, i)
+			}
+		}
+	}
+
+	orders := []*condOrder{}
+	result := Find(engine.Context(ctx), &orders, NewSelect("id"), NewIsNull("note"))
+	if result.Count() != 0 {
+		t.Fatal("empty strings are not null")
+	}
+	result = Count(engine.Context(ctx), &condOrder{}, NewEq("user_id", 1))
+	if result.HasError() || result.Count() != 2 {
+		t.Fatalf("count %d, err %v", result.Count(), result.Error())
+	}
+	if Exist(engine.Context(ctx), &condOrder{}, NewEq("amount", 50)).HasFound() {
+		t.Fatal("no order of 50")
+	}
+
+	type userTotal struct {
+		Name  string
+		Total int
+	}
+	totals := []*userTotal{}
+	result = Find(engine.Context(ctx).Table("group_user").Select("group_user.name, sum(cond_order.amount) as total"), &totals,
+		NewJoin("INNER", "cond_order", "cond_order.user_id = group_user.id"),
+		NewGroupBy("group_user.name"),
+		NewHaving("sum(cond_order.amount) > 50"))
+	if result.HasError() || result.Count() != 1 || totals[0].Name != "bob" || totals[0].Total != 70 {
+		t.Fatalf("unexpected totals %v, err %v", totals, result.Error())
+	}
+}
@@ -1,6 +1,7 @@
 package sql
 
 import (
+	"context"
 	"time"
 
 	"github.com/pkg/errors"
@@ -30,19 +31,74 @@ type EngineConfig struct {
 	NameMapperType  string       `default:"snake"`
 	NameMapper      names.Mapper `json:"-"`
 	ShowSql         bool         `default:"true"`
+	// Replicas serve the reads of an engine group, see NewEngineGroup.
+	Replicas      []ReplicaConfig `validate:"dive"`
+	ReplicaPolicy string          `default:"roundRobin" validate:"oneof=random weightRandom roundRobin weightRoundRobin leastConn"`
+	HealthCheck   struct {
+		Interval time.Duration `default:"10s" validate:"gt=0"`
+		Timeout  time.Duration `default:"2s" validate:"gt=0"`
+	}
+	// SlowQuery logs statements slower than Threshold, negative to disable, with
+	// their args in full, redacted to keep only non string values, or none.
+	SlowQuery struct {
+		Threshold time.Duration `default:"1s"`
+		Args      string        `default:"redacted" validate:"oneof=full redacted none"`
+	}
+	Cache CacheConfig
+}
+
+type ReplicaConfig struct {
+	Uri    string `validate:"required"`
+	Weight int    `default:"1" validate:"gt=0"`
 }
 
+// EngineSchema is the config schema of an engine, for the application to
+// register under the key of each of its databases, like
+// schema.Register("orders_db", sql.EngineSchema).
+var EngineSchema = EngineConfig{}
+
 type Session struct {
 	*xorm.Session
+	ctx        context.Context
+	savepoints int
+}
+
+// Engine is an *xorm.Engine or an *EngineGroup.
+type Engine interface {
+	xorm.EngineInterface
+	Close() error
 }
 
+// Open returns an EngineGroup if config has Replicas, or else the engine of Uri.
+func Open(config *EngineConfig) (Engine, error) {
+	if len(config.Replicas) > 0 {
+		return NewEngineGroup(config)
+	}
+	return NewEngine(config)
+}
+
+// NewEngine returns the engine of Uri only, use Open or NewEngineGroup to read
+// from the Replicas.
 func NewEngine(config *EngineConfig) (*xorm.Engine, error) {
 	err := structs.SetDefaultsAndValidate(config)
 	if err != nil {
 		return nil, err
 	}
 
-	x, err := xorm.NewEngine(config.Type, config.Uri)
+	if len(config.Replicas) > 0 {
+		log.Warnw("db replicas configured but unused, use Open or NewEngineGroup")
+	}
+	x, err := newEngine(config, config.Uri)
+	if err != nil {
+		return nil, err
+	}
+	setCacher(&config.Cache, x, config.Cache.Prefix, nil)
+	return x, nil
+}
+
+// newEngine creates an engine of uri with the pool, logger and mapper settings of config.
+func newEngine(config *EngineConfig, uri string) (*xorm.Engine, error) {
+	x, err := xorm.NewEngine(config.Type, uri)
 	if err != nil {
 		return nil, errors.WithMessage(err, "create xorm engine error")
 	}
@@ -91,10 +147,14 @@ func NewEngine(config *EngineConfig) (*xorm.Engine, error) {
 	x.SetTableMapper(core.NewPrefixMapper(config.NameMapper, ""))
 	x.SetColumnMapper(config.NameMapper)
 	x.ShowSQL(config.ShowSql)
+	x.AddHook(newQueryHook(config, x))
 
 	return x, nil
 }
 
+// Logger is the xorm context logger of an engine, logging sql with the fields of
+// the session context from log.NewContext, such as the request id. Its level is
+// independent of other engines and the default logger.
 type Logger struct {
 	logger  *log.Logger
 	level   xlog.LogLevel
@@ -145,12 +205,35 @@ func (self *Logger) SetLevel(l xlog.LogLevel) {
 		zl = zapcore.DebugLevel
 	case xlog.LOG_INFO:
 		zl = zapcore.InfoLevel
-	default:
+	case xlog.LOG_WARNING:
+		zl = zapcore.WarnLevel
+	case xlog.LOG_ERR:
 		zl = zapcore.ErrorLevel
+	default:
+		zl = zapcore.FatalLevel + 1
 	}
 	self.logger.SetLevel(zl)
 }
 
+func (self *Logger) BeforeSQL(ctx xlog.LogContext) {
+}
+
+func (self *Logger) AfterSQL(ctx xlog.LogContext) {
+	kvs := []interface{}{"sql", ctx.SQL, "args", ctx.Args}
+	if ctx.ExecuteTime > 0 {
+		kvs = append(kvs, "elapsed", ctx.ExecuteTime)
+	}
+	if id, ok := ctx.Ctx.Value(xlog.SessionIDKey).(string); ok {
+		kvs = append(kvs, "session", id)
+	}
+	logger := self.logger.Ctx(ctx.Ctx)
+	if ctx.Err != nil {
+		logger.WithError(ctx.Err).Errorw("sql", kvs...)
+		return
+	}
+	logger.Infow("sql", kvs...)
+}
+
 func (self *Logger) ShowSQL(show ...bool) {
 	isShow := true
 	if len(show) > 0 {
@@ -0,0 +1,267 @@
+package sql
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"xorm.io/xorm"
+	"xorm.io/xorm/contexts"
+
+	"go.yym.plus/zeus/pkg/log"
+	"go.yym.plus/zeus/pkg/utils/structs"
+)
+
+// EngineGroup sends writes and transactions to the primary and reads to the
+// healthy replicas by the replica policy, or to the primary if none is healthy.
+type EngineGroup struct {
+	*xorm.EngineGroup
+	config   *EngineConfig
+	replicas []*replica
+	counter  uint64
+	lock     sync.Mutex
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type replica struct {
+	engine  *xorm.Engine
+	uri     string
+	weight  int
+	current int
+	healthy int32
+}
+
+type primaryKey struct{}
+
+type uncachedKey struct{}
+
+// WithPrimary returns a context whose sessions from EngineGroup.Context read from
+// the primary, for reading your own writes despite replication lag.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// IsPrimary reports whether ctx forces primary reads.
+func IsPrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryKey{}).(bool)
+	return primary
+}
+
+// NewEngineGroup creates the primary engine of Uri and a replica engine for each
+// of Replicas, and checks the health of the replicas every HealthCheck.Interval.
+// Only the primary is cached and the replica reads of Context skip the cache, as
+// a lagging replica would fill it with rows that writes to the primary invalidated.
+func NewEngineGroup(config *EngineConfig) (*EngineGroup, error) {
+	err := structs.SetDefaultsAndValidate(config)
+	if err != nil {
+		return nil, err
+	}
+	primary, err := newEngine(config, config.Uri)
+	if err != nil {
+		return nil, err
+	}
+	setCacher(&config.Cache, primary, config.Cache.Prefix, nil)
+	primary.AddHook(&uncachedHook{engine: primary})
+	group := &EngineGroup{
+		config: config,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	// xorm skips the policy when there is one slave, the primary is appended as
+	// the last slave so the policy always runs and can fall back to it.
+	slaves := []*xorm.Engine{}
+	for _, r := range config.Replicas {
+		engine, err := newEngine(config, r.Uri)
+		if err != nil {
+			primary.Close()
+			for _, s := range slaves {
+				s.Close()
+			}
+			return nil, err
+		}
+		slaves = append(slaves, engine)
+		group.replicas = append(group.replicas, &replica{
+			engine:  engine,
+			uri:     r.Uri,
+			weight:  r.Weight,
+			healthy: 1,
+		})
+	}
+	slaves = append(slaves, primary)
+	group.EngineGroup, err = xorm.NewEngineGroup(primary, slaves, xorm.GroupPolicyHandler(group.slave))
+	if err != nil {
+		return nil, errors.WithMessage(err, "create xorm engine group error")
+	}
+	go group.healthCheck()
+	return group, nil
+}
+
+// Context returns an auto close session of ctx, on the primary only if ctx is
+// from WithPrimary. Sessions reading from replicas don't use the cache.
+func (self *EngineGroup) Context(ctx context.Context) *xorm.Session {
+	if IsPrimary(ctx) {
+		return self.Master().Context(ctx)
+	}
+	// xorm caches the rows read from a replica in the cacher of the primary
+	return self.EngineGroup.Context(context.WithValue(ctx, uncachedKey{}, true)).NoCache()
+}
+
+// Replicas returns the replica engines, Slaves also contains the primary.
+func (self *EngineGroup) Replicas() []*xorm.Engine {
+	engines := make([]*xorm.Engine, 0, len(self.replicas))
+	for _, r := range self.replicas {
+		engines = append(engines, r.engine)
+	}
+	return engines
+}
+
+// Healthy returns the replica engines passing the health check.
+func (self *EngineGroup) Healthy() []*xorm.Engine {
+	engines := []*xorm.Engine{}
+	for _, r := range self.healthy() {
+		engines = append(engines, r.engine)
+	}
+	return engines
+}
+
+// Close stops the health check and closes all engines.
+func (self *EngineGroup) Close() error {
+	select {
+	case <-self.stop:
+	default:
+		close(self.stop)
+		<-self.done
+	}
+	return self.EngineGroup.Close()
+}
+
+func (self *EngineGroup) healthy() []*replica {
+	replicas := make([]*replica, 0, len(self.replicas))
+	for _, r := range self.replicas {
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			replicas = append(replicas, r)
+		}
+	}
+	return replicas
+}
+
+// slave is the xorm group policy picking a healthy replica.
+func (self *EngineGroup) slave(g *xorm.EngineGroup) *xorm.Engine {
+	replicas := self.healthy()
+	switch len(replicas) {
+	case 0:
+		return g.Master()
+	case 1:
+		return replicas[0].engine
+	}
+	switch self.config.ReplicaPolicy {
+	case "random":
+		return replicas[rand.Intn(len(replicas))].engine
+	case "weightRandom":
+		total := 0
+		for _, r := range replicas {
+			total += r.weight
+		}
+		n := rand.Intn(total)
+		for _, r := range replicas {
+			if n < r.weight {
+				return r.engine
+			}
+			n -= r.weight
+		}
+		return replicas[len(replicas)-1].engine
+	case "weightRoundRobin":
+		// smooth weighted round robin, as nginx does
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		total := 0
+		var best *replica
+		for _, r := range replicas {
+			r.current += r.weight
+			total += r.weight
+			if best == nil || r.current > best.current {
+				best = r
+			}
+		}
+		best.current -= total
+		return best.engine
+	case "leastConn":
+		best := replicas[0]
+		for _, r := range replicas[1:] {
+			if r.engine.DB().Stats().InUse < best.engine.DB().Stats().InUse {
+				best = r
+			}
+		}
+		return best.engine
+	default:
+		n := atomic.AddUint64(&self.counter, 1)
+		return replicas[n%uint64(len(replicas))].engine
+	}
+}
+
+func (self *EngineGroup) healthCheck() {
+	defer close(self.done)
+	if len(self.replicas) == 0 {
+		return
+	}
+	ticker := time.NewTicker(self.config.HealthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		self.checkReplicas()
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (self *EngineGroup) checkReplicas() {
+	for _, r := range self.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), self.config.HealthCheck.Timeout)
+		err := r.engine.PingContext(ctx)
+		cancel()
+		if err != nil {
+			if atomic.SwapInt32(&r.healthy, 0) == 1 {
+				log.WithError(err).Warnw("db replica unhealthy, reads skip it", "replica", replicaName(r.uri))
+			}
+		} else if atomic.SwapInt32(&r.healthy, 1) == 0 {
+			log.Infow("db replica healthy again", "replica", replicaName(r.uri))
+		}
+	}
+}
+
+// uncachedHook clears the cache of the tables written by the sessions of
+// EngineGroup.Context, which xorm skips for sessions without cache.
+type uncachedHook struct {
+	engine *xorm.Engine
+}
+
+func (self *uncachedHook) BeforeProcess(c *contexts.ContextHook) (context.Context, error) {
+	return c.Ctx, nil
+}
+
+func (self *uncachedHook) AfterProcess(c *contexts.ContextHook) error {
+	if c.Err != nil || c.Ctx.Value(uncachedKey{}) == nil {
+		return nil
+	}
+	operation, table := parseStatement(c.SQL)
+	if operation == "select" || table == "" {
+		return nil
+	}
+	if cacher := self.engine.GetCacher(table); cacher != nil {
+		cacher.ClearIds(table)
+		cacher.ClearBeans(table)
+	}
+	return nil
+}
+
+// replicaName strips the credentials of a dsn like user:pass@tcp(host)/db.
+func replicaName(uri string) string {
+	return uri[strings.LastIndex(uri, "@")+1:]
+}
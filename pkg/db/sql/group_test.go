@@ -0,0 +1,142 @@
+package sql
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"xorm.io/xorm"
+)
+
+type groupUser struct {
+	Id   int64
+	Name string
+}
+
+func newSqliteEngine(t *testing.T, file, name string) {
+	x, err := xorm.NewEngine("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	err = x.Sync2(&groupUser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = x.Insert(&groupUser{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestGroup(t *testing.T, policy string, replicas ...string) *EngineGroup {
+	dir := t.TempDir()
+	primary := filepath.Join(dir, "primary.db")
+	newSqliteEngine(t, primary, "primary")
+	config := &EngineConfig{
+		Type:          "sqlite3",
+		Uri:           primary,
+		LogLevel:      "off",
+		ReplicaPolicy: policy,
+	}
+	for i, name := range replicas {
+		file := filepath.Join(dir, name+".db")
+		newSqliteEngine(t, file, name)
+		config.Replicas = append(config.Replicas, ReplicaConfig{Uri: file, Weight: i + 1})
+	}
+	group, err := NewEngineGroup(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return group
+}
+
+func readName(t *testing.T, s *xorm.Session) string {
+	user := &groupUser{}
+	has, err := s.Get(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !has {
+		t.Fatal("no user")
+	}
+	return user.Name
+}
+
+func TestEngineGroup(t *testing.T) {
+	group := newTestGroup(t, "roundRobin", "replica")
+	defer group.Close()
+	ctx := context.Background()
+
+	if name := readName(t, group.Context(ctx)); name != "replica" {
+		t.Fatalf("read from %s", name)
+	}
+	if name := readName(t, group.Context(WithPrimary(ctx))); name != "primary" {
+		t.Fatalf("forced primary read from %s", name)
+	}
+	_, err := group.Context(ctx).Insert(&groupUser{Name: "written"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := group.Master().Count(&groupUser{})
+	if err != nil || count != 2 {
+		t.Fatalf("write not on primary, count %d, err %v", count, err)
+	}
+
+	group.Replicas()[0].Close()
+	group.checkReplicas()
+	if len(group.Healthy()) != 0 {
+		t.Fatal("closed replica still healthy")
+	}
+	if name := readName(t, group.Context(ctx)); name != "primary" {
+		t.Fatalf("read from %s without healthy replica", name)
+	}
+}
+
+func TestEngineGroupPolicy(t *testing.T) {
+	group := newTestGroup(t, "weightRoundRobin", "a", "b")
+	defer group.Close()
+
+	picks := map[*xorm.Engine]int{}
+	for i := 0; i < 30; i++ {
+		picks[group.Slave()]++
+	}
+	replicas := group.Replicas()
+	if picks[replicas[0]] != 10 || picks[replicas[1]] != 20 {
+		t.Fatalf("unexpected weighted picks %d, %d", picks[replicas[0]], picks[replicas[1]])
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	primary := filepath.Join(dir, "primary.db")
+	replica := filepath.Join(dir, "replica.db")
+	newSqliteEngine(t, primary, "primary")
+	newSqliteEngine(t, replica, "replica")
+
+	engine, err := Open(&EngineConfig{Type: "sqlite3", Uri: primary, LogLevel: "off"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Close()
+	if _, ok := engine.(*xorm.Engine); !ok {
+		t.Fatalf("expect an engine without replicas, got %T", engine)
+	}
+
+	config := &EngineConfig{Type: "sqlite3", Uri: primary, LogLevel: "off", Replicas: []ReplicaConfig{{Uri: replica}}}
+	engine, err = Open(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Close()
+	if _, ok := engine.(*EngineGroup); !ok {
+		t.Fatalf("expect an engine group with replicas, got %T", engine)
+	}
+
+	config.HealthCheck.Interval = -time.Second
+	_, err = Open(config)
+	if err == nil {
+		t.Fatal("expect error for negative health check interval")
+	}
+}
@@ -0,0 +1,159 @@
+package sql
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"xorm.io/builder"
+	"xorm.io/xorm"
+	"xorm.io/xorm/dialects"
+)
+
+// Keyset paginates by the sort keys of the last row of the previous page instead
+// of an offset, so pages stay fast on big tables and don't skip or repeat rows
+// under concurrent writes. The order columns must together be unique, such as
+// ending with the primary key, and not null. A Keyset is immutable and may be
+// shared between goroutines.
+type Keyset struct {
+	size   int32
+	cursor string
+	orders []keysetOrder
+}
+
+type keysetOrder struct {
+	column string
+	desc   bool
+}
+
+// NewKeyset returns the page of size rows after cursor, empty for the first page,
+// ordered by orders like "created_at desc" and "id".
+func NewKeyset(size int32, cursor string, orders ...string) *Keyset {
+	keyset := &Keyset{size: size, cursor: cursor}
+	for _, order := range orders {
+		fields := strings.Fields(order)
+		if len(fields) == 0 {
+			continue
+		}
+		keyset.orders = append(keyset.orders, keysetOrder{
+			column: fields[0],
+			desc:   len(fields) > 1 && strings.EqualFold(fields[1], "desc"),
+		})
+	}
+	return keyset
+}
+
+func (self *Keyset) Apply(s *xorm.Session) error {
+	if len(self.orders) == 0 {
+		return errors.New("keyset pagination needs order columns")
+	}
+	if self.cursor != "" {
+		values, err := self.decode()
+		if err != nil {
+			return err
+		}
+		// (a > ?) OR (a = ? AND b > ?) OR ...
+		or := builder.NewCond()
+		for i, order := range self.orders {
+			and := builder.NewCond()
+			for j := 0; j < i; j++ {
+				and = and.And(builder.Eq{self.orders[j].column: values[j]})
+			}
+			if order.desc {
+				and = and.And(builder.Lt{order.column: values[i]})
+			} else {
+				and = and.And(builder.Gt{order.column: values[i]})
+			}
+			or = or.Or(and)
+		}
+		s.And(or)
+	}
+	for _, order := range self.orders {
+		if order.desc {
+			s.Desc(order.column)
+		} else {
+			s.Asc(order.column)
+		}
+	}
+	s.Limit(int(self.size))
+	return nil
+}
+
+// Next returns the cursor of the page after rowsSlicePtr, the rows found with the
+// keyset on db, an engine, engine group or session, or empty if it is the last
+// page.
+func (self *Keyset) Next(db xorm.Interface, rowsSlicePtr interface{}) (string, error) {
+	engine := engineOf(db)
+	if engine == nil {
+		return "", errors.Errorf("keyset engine of %T unknown", db)
+	}
+	rows := reflect.Indirect(reflect.ValueOf(rowsSlicePtr))
+	if rows.Kind() != reflect.Slice {
+		return "", errors.New("keyset rows must be a pointer to a slice")
+	}
+	if rows.Len() == 0 || rows.Len() < int(self.size) {
+		return "", nil
+	}
+	last := rows.Index(rows.Len() - 1)
+	if last.Kind() != reflect.Ptr {
+		last = last.Addr()
+	}
+	table, err := engine.TableInfo(last.Interface())
+	if err != nil {
+		return "", errors.WithMessage(err, "keyset table")
+	}
+	values := make([]interface{}, 0, len(self.orders))
+	for _, order := range self.orders {
+		name := order.column[strings.LastIndex(order.column, ".")+1:]
+		col := table.GetColumn(strings.Trim(name, "`\"[]"))
+		if col == nil {
+			return "", errors.Errorf("keyset column %s not in %s", order.column, table.Name)
+		}
+		field, err := col.ValueOf(last.Interface())
+		if err != nil {
+			return "", errors.WithMessagef(err, "keyset column %s", order.column)
+		}
+		value := field.Interface()
+		if t, ok := value.(time.Time); ok {
+			// compare as stored, which is a string or unix time on some databases
+			value = dialects.FormatColumnTime(engine.Dialect(), engine.DatabaseTZ, col, t)
+		}
+		values = append(values, value)
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", errors.WithMessage(err, "encode keyset cursor")
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func (self *Keyset) decode() ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(self.cursor)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid keyset cursor")
+	}
+	values := []interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&values)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid keyset cursor")
+	}
+	if len(values) != len(self.orders) {
+		return nil, errors.New("invalid keyset cursor: order columns changed")
+	}
+	for i, value := range values {
+		if number, ok := value.(json.Number); ok {
+			if n, err := number.Int64(); err == nil {
+				values[i] = n
+			} else if f, err := number.Float64(); err == nil {
+				values[i] = f
+			}
+		}
+	}
+	return values, nil
+}
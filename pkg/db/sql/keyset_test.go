@@ -0,0 +1,110 @@
+package sql
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type keysetEvent struct {
+	Id        int64
+	Score     int
+	CreatedAt time.Time
+}
+
+func TestKeyset(t *testing.T) {
+	engine := newTxEngine(t)
+	defer engine.Close()
+	err := engine.Sync2(&keysetEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	events := []*keysetEvent{}
+	for i := 0; i < 7; i++ {
+		// scores repeat so the id breaks ties
+		events = append(events, &keysetEvent{Score: i % 3, CreatedAt: start.Add(time.Duration(i%2) * time.Hour)})
+	}
+	_, err = engine.Insert(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	pages := func(orders ...string) []int64 {
+		ids := []int64{}
+		cursor := ""
+		for i := 0; i < 10; i++ {
+			keyset := NewKeyset(3, cursor, orders...)
+			page := []*keysetEvent{}
+			result := Find(engine.Context(ctx), &page, keyset)
+			if result.HasError() {
+				t.Fatal(result.Error())
+			}
+			for _, event := range page {
+				ids = append(ids, event.Id)
+			}
+			cursor, err = keyset.Next(engine, &page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cursor == "" {
+				return ids
+			}
+		}
+		t.Fatal("pagination not ending")
+		return nil
+	}
+	for _, c := range []struct {
+		orders []string
+		ids    []int64
+	}{
+		{[]string{"id"}, []int64{1, 2, 3, 4, 5, 6, 7}},
+		{[]string{"score desc", "id"}, []int64{3, 6, 2, 5, 1, 4, 7}},
+		{[]string{"score", "id desc"}, []int64{7, 4, 1, 5, 2, 6, 3}},
+		{[]string{"created_at desc", "id desc"}, []int64{6, 4, 2, 7, 5, 3, 1}},
+	} {
+		ids := pages(c.orders...)
+		if len(ids) != len(c.ids) {
+			t.Fatalf("%v: unexpected ids %v", c.orders, ids)
+		}
+		for i := range ids {
+			if ids[i] != c.ids[i] {
+				t.Fatalf("%v: unexpected ids %v", c.orders, ids)
+			}
+		}
+	}
+
+	// within a transaction
+	err = WithTx(ctx, engine, func(s *Session) error {
+		keyset := NewKeyset(3, "", "id")
+		page := []*keysetEvent{}
+		result := Find(s.Session, &page, keyset)
+		if result.HasError() {
+			return result.Error()
+		}
+		cursor, err := keyset.Next(s, &page)
+		if err != nil {
+			return err
+		}
+		page = []*keysetEvent{}
+		result = Find(s.Session, &page, NewKeyset(3, cursor, "id"))
+		if result.HasError() || len(page) != 3 || page[0].Id != 4 {
+			t.Fatalf("unexpected page %v in transaction, err %v", page, result.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := []*keysetEvent{}
+	if !Find(engine.Context(ctx), &page, NewKeyset(3, "bad cursor", "id")).HasError() {
+		t.Fatal("invalid cursor accepted")
+	}
+	page = []*keysetEvent{}
+	result := Find(engine.Context(ctx), &page, NewPagination(3, 0))
+	if result.HasError() || result.Count() != 3 || page[0].Id != 1 {
+		t.Fatalf("page 0 is the first page, err %v", result.Error())
+	}
+}
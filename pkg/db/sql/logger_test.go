@@ -0,0 +1,73 @@
+package sql
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"xorm.io/xorm/contexts"
+	xlog "xorm.io/xorm/log"
+
+	"go.yym.plus/zeus/pkg/log"
+)
+
+func TestLogger(t *testing.T) {
+	// the file core writes to ./log by default
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	disabled := false
+	config := &log.Config{Level: "info"}
+	config.Console.Enable = &disabled
+	base := log.New(config)
+	defaultLogger := log.Default()
+	log.SetDefault(base)
+	defer log.SetDefault(defaultLogger)
+	a := &Logger{logger: base.Clone()}
+	b := &Logger{logger: base.Clone()}
+	a.SetLevel(xlog.LOG_DEBUG)
+	b.SetLevel(xlog.LOG_OFF)
+
+	ctx := log.NewContext(context.Background(), "requestId", "req-1")
+	ctx = log.NewContext(ctx, "traceId", "trace-1")
+	hook := contexts.NewContextHook(ctx, "SELECT 1", []interface{}{2})
+	a.AfterSQL(xlog.LogContext(*hook))
+	b.AfterSQL(xlog.LogContext(*contexts.NewContextHook(ctx, "SELECT 2", nil)))
+	a.Debugf("debug %d", 3)
+	base.Debug("base stays at info")
+	slow := contexts.NewContextHook(log.NewContext(context.Background(), "requestId", "req-slow"), "SELECT 3", nil)
+	slow.ExecuteTime = time.Second
+	(&queryHook{db: "test", threshold: time.Millisecond, args: "none"}).AfterProcess(slow)
+
+	files, err := filepath.Glob(filepath.Join(dir, "log", "log*.log"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("log files %v, err %v", files, err)
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	for _, expect := range []string{`"sql":"SELECT 1"`, `"requestId":"req-1"`, `"traceId":"trace-1"`, "debug 3",
+		`"requestId":"req-slow"`} {
+		if !strings.Contains(content, expect) {
+			t.Fatalf("%s not logged in %s", expect, content)
+		}
+	}
+	for _, unexpected := range []string{"SELECT 2", "base stays at info"} {
+		if strings.Contains(content, unexpected) {
+			t.Fatalf("%s logged despite the level", unexpected)
+		}
+	}
+}
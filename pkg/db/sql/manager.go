@@ -0,0 +1,355 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"xorm.io/xorm"
+
+	"go.yym.plus/zeus/pkg/log"
+	"go.yym.plus/zeus/pkg/utils/structs"
+)
+
+// ManagerConfig configures the engines of a Manager.
+type ManagerConfig struct {
+	// Engines are engines by name, "default" serves contexts without tenant and
+	// shard key.
+	Engines map[string]*EngineConfig
+	// Tenant is the engine config of every tenant, with {tenant} in Uri replaced
+	// by the tenant id, such as in the schema name.
+	Tenant *EngineConfig
+	// Shards route shard keys by hash, each to an engine of Engines whose
+	// ShardTables get the table suffix of the shard, so shards may share an
+	// instance in different tables.
+	Shards      []ShardConfig `validate:"dive"`
+	ShardTables []string
+	// IdleTimeout closes engines unused for that long, reopened on use.
+	IdleTimeout time.Duration `default:"10m" validate:"gt=0"`
+}
+
+type ShardConfig struct {
+	Engine      string `validate:"required"`
+	TableSuffix string
+}
+
+// Manager opens engines lazily by name, tenant or shard and closes them when
+// idle. Tables named by a TableName method are not suffixed.
+//
+// An engine is closed once unused for IdleTimeout unless leased by Do, so callers
+// hold an engine for a unit of work, such as a request or a transaction, within
+// Do, or get it from the manager again for every query. Engines of the manager
+// cache in redis under the Cache.Prefix of their config followed by their key,
+// like zeus:xorm:tenant:acme:.
+type Manager struct {
+	config  *ManagerConfig
+	lock    sync.Mutex
+	engines map[string]*managedEngine
+	tables  map[string]bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type managedEngine struct {
+	engine   *xorm.Engine
+	lastUsed int64
+	leases   int32
+}
+
+type tenantKey struct{}
+
+type shardKey struct{}
+
+var tenantRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// WithTenant returns a context routed by Manager.Route to the engine of tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFrom returns the tenant of ctx, empty if there is none.
+func TenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// WithShardKey returns a context routed by Manager.Route to the shard of key,
+// such as a user id.
+func WithShardKey(ctx context.Context, key interface{}) context.Context {
+	return context.WithValue(ctx, shardKey{}, key)
+}
+
+// ShardKeyFrom returns the shard key of ctx, nil if there is none.
+func ShardKeyFrom(ctx context.Context) interface{} {
+	return ctx.Value(shardKey{})
+}
+
+// NewManager validates the engine configs, engines are opened on first use.
+// Managed engines have no replicas, use NewEngineGroup for those.
+func NewManager(config *ManagerConfig) (*Manager, error) {
+	// the engine configs first, validated with the manager config after
+	for name, engine := range config.Engines {
+		err := structs.SetDefaultsAndValidate(engine)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "engine %s", name)
+		}
+		if len(engine.Replicas) > 0 {
+			return nil, errors.Errorf("engine %s has replicas, unsupported by the manager", name)
+		}
+	}
+	if config.Tenant != nil {
+		err := structs.SetDefaultsAndValidate(config.Tenant)
+		if err != nil {
+			return nil, errors.WithMessage(err, "tenant engine")
+		}
+		if len(config.Tenant.Replicas) > 0 {
+			return nil, errors.New("tenant engine has replicas, unsupported by the manager")
+		}
+		if !strings.Contains(config.Tenant.Uri, "{tenant}") {
+			return nil, errors.New("tenant engine uri has no {tenant}")
+		}
+	}
+	err := structs.SetDefaultsAndValidate(config)
+	if err != nil {
+		return nil, err
+	}
+	for i, shard := range config.Shards {
+		if _, ok := config.Engines[shard.Engine]; !ok {
+			return nil, errors.Errorf("shard %d engine %s not found", i, shard.Engine)
+		}
+	}
+	m := &Manager{
+		config:  config,
+		engines: map[string]*managedEngine{},
+		tables:  map[string]bool{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, table := range config.ShardTables {
+		m.tables[table] = true
+	}
+	go m.closeIdle()
+	return m, nil
+}
+
+// Engine returns the engine named name.
+func (self *Manager) Engine(name string) (*xorm.Engine, error) {
+	return unleased(self.engine(name))
+}
+
+// Tenant returns the engine of tenant.
+func (self *Manager) Tenant(tenant string) (*xorm.Engine, error) {
+	return unleased(self.tenant(tenant))
+}
+
+// Shard returns the engine of the shard of key.
+func (self *Manager) Shard(key interface{}) (*xorm.Engine, error) {
+	return unleased(self.shard(key))
+}
+
+// ShardOf returns the index in Shards of the shard of key.
+func (self *Manager) ShardOf(key interface{}) int {
+	h := fnv.New32a()
+	fmt.Fprint(h, key)
+	return int(h.Sum32() % uint32(len(self.config.Shards)))
+}
+
+// Route returns the engine of the tenant of ctx, or else the shard of its shard
+// key, or else the default engine. The engine may be closed once idle, use Do to
+// hold it for a unit of work.
+func (self *Manager) Route(ctx context.Context) (*xorm.Engine, error) {
+	return unleased(self.route(ctx))
+}
+
+// Do runs fn with the engine routed by Route, which isn't closed while fn runs
+// however long it is idle.
+func (self *Manager) Do(ctx context.Context, fn func(engine *xorm.Engine) error) error {
+	e, err := self.route(ctx)
+	if err != nil {
+		return err
+	}
+	defer e.release()
+	return fn(e.engine)
+}
+
+// Context returns an auto close session of ctx on the engine routed by Route.
+func (self *Manager) Context(ctx context.Context) (*xorm.Session, error) {
+	engine, err := self.Route(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return engine.Context(ctx), nil
+}
+
+// Opened returns the keys of the open engines, like engine:default, tenant:acme
+// and shard:0, sorted.
+func (self *Manager) Opened() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	keys := make([]string, 0, len(self.engines))
+	for key := range self.engines {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Close stops closing idle engines and closes all engines.
+func (self *Manager) Close() error {
+	select {
+	case <-self.stop:
+	default:
+		close(self.stop)
+		<-self.done
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var err error
+	for key, e := range self.engines {
+		if cerr := e.engine.Close(); cerr != nil && err == nil {
+			err = errors.WithMessagef(cerr, "close engine %s", key)
+		}
+		delete(self.engines, key)
+	}
+	return err
+}
+
+func (self *Manager) route(ctx context.Context) (*managedEngine, error) {
+	if tenant := TenantFrom(ctx); tenant != "" {
+		return self.tenant(tenant)
+	}
+	if key := ShardKeyFrom(ctx); key != nil {
+		return self.shard(key)
+	}
+	return self.engine("default")
+}
+
+func (self *Manager) engine(name string) (*managedEngine, error) {
+	config, ok := self.config.Engines[name]
+	if !ok {
+		return nil, errors.Errorf("engine %s not found", name)
+	}
+	return self.open("engine:"+name, func() (*xorm.Engine, error) {
+		return newManagedEngine("engine:"+name, config, config.Uri, nil)
+	})
+}
+
+func (self *Manager) tenant(tenant string) (*managedEngine, error) {
+	if self.config.Tenant == nil {
+		return nil, errors.New("tenant engine not configured")
+	}
+	if !tenantRe.MatchString(tenant) {
+		return nil, errors.Errorf("tenant id %q invalid", tenant)
+	}
+	return self.open("tenant:"+tenant, func() (*xorm.Engine, error) {
+		return newManagedEngine("tenant:"+tenant, self.config.Tenant, strings.Replace(self.config.Tenant.Uri, "{tenant}", tenant, -1), nil)
+	})
+}
+
+func (self *Manager) shard(key interface{}) (*managedEngine, error) {
+	if len(self.config.Shards) == 0 {
+		return nil, errors.New("shards not configured")
+	}
+	i := self.ShardOf(key)
+	shard := self.config.Shards[i]
+	name := fmt.Sprintf("shard:%d", i)
+	return self.open(name, func() (*xorm.Engine, error) {
+		config := self.config.Engines[shard.Engine]
+		return newManagedEngine(name, config, config.Uri, &shardTableMapper{tables: self.tables, suffix: shard.TableSuffix})
+	})
+}
+
+// open returns the engine of key leased, to be released by the caller. The lease
+// is taken under the lock so that reap can't close the engine before.
+func (self *Manager) open(key string, create func() (*xorm.Engine, error)) (*managedEngine, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	e, ok := self.engines[key]
+	if !ok {
+		engine, err := create()
+		if err != nil {
+			return nil, errors.WithMessagef(err, "open engine %s", key)
+		}
+		e = &managedEngine{engine: engine}
+		self.engines[key] = e
+	}
+	atomic.AddInt32(&e.leases, 1)
+	atomic.StoreInt64(&e.lastUsed, time.Now().UnixNano())
+	return e, nil
+}
+
+// release returns a lease of open, the engine is idle from now on if it was the
+// last.
+func (self *managedEngine) release() {
+	atomic.StoreInt64(&self.lastUsed, time.Now().UnixNano())
+	atomic.AddInt32(&self.leases, -1)
+}
+
+// unleased releases e at once for the callers which don't hold it.
+func unleased(e *managedEngine, err error) (*xorm.Engine, error) {
+	if err != nil {
+		return nil, err
+	}
+	e.release()
+	return e.engine, nil
+}
+
+func (self *Manager) closeIdle() {
+	defer close(self.done)
+	ticker := time.NewTicker(self.config.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case now := <-ticker.C:
+			self.reap(now)
+		}
+	}
+}
+
+// reap closes the engines unused since IdleTimeout before now, neither leased
+// nor in use.
+func (self *Manager) reap(now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for key, e := range self.engines {
+		idle := now.Sub(time.Unix(0, atomic.LoadInt64(&e.lastUsed)))
+		if idle < self.config.IdleTimeout || atomic.LoadInt32(&e.leases) > 0 || e.engine.DB().Stats().InUse > 0 {
+			continue
+		}
+		delete(self.engines, key)
+		err := e.engine.Close()
+		if err != nil {
+			log.WithError(err).Warnw("close idle engine failed", "engine", key)
+			continue
+		}
+		log.Infow("idle engine closed", "engine", key, "idle", idle)
+	}
+}
+
+// newManagedEngine creates the engine of key of uri by config, which the manager
+// has validated, with the tables of shard if not nil.
+func newManagedEngine(key string, config *EngineConfig, uri string, shard *shardTableMapper) (*xorm.Engine, error) {
+	engine, err := newEngine(config, uri)
+	if err != nil {
+		return nil, err
+	}
+	var tableName func(string) string
+	if shard != nil {
+		// newEngine has set the name mapper
+		shard.Mapper = config.NameMapper
+		engine.SetTableMapper(*shard)
+		tableName = shard.table
+	}
+	// engines sharing the config must not share cache entries
+	setCacher(&config.Cache, engine, config.Cache.Prefix+key+":", tableName)
+	return engine, nil
+}
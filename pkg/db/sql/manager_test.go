@@ -0,0 +1,190 @@
+package sql
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"xorm.io/xorm"
+)
+
+type shardOrder struct {
+	Id     int64
+	UserId int64
+}
+
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+	engine := func(name string) *EngineConfig {
+		return &EngineConfig{Type: "sqlite3", Uri: filepath.Join(dir, name+".db"), LogLevel: "off"}
+	}
+	m, err := NewManager(&ManagerConfig{
+		Engines: map[string]*EngineConfig{
+			"default": engine("default"),
+			"a":       engine("a"),
+			"b":       engine("b"),
+		},
+		Tenant: engine("tenant_{tenant}"),
+		Shards: []ShardConfig{
+			{Engine: "a", TableSuffix: "_0"},
+			{Engine: "a", TableSuffix: "_1"},
+			{Engine: "b", TableSuffix: "_2"},
+		},
+		ShardTables: []string{"shard_order"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	ctx := context.Background()
+
+	// each shard key lands in the table of its shard
+	for i := int64(1); i <= 30; i++ {
+		s, err := m.Context(WithShardKey(ctx, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Sync2(&shardOrder{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Insert(&shardOrder{UserId: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := m.Engine("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := int64(0)
+	for i, table := range []string{"shard_order_0", "shard_order_1"} {
+		orders := []*shardOrder{}
+		err = a.Table(table).Find(&orders)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, order := range orders {
+			if m.ShardOf(order.UserId) != i {
+				t.Fatalf("order of %d in %s", order.UserId, table)
+			}
+		}
+		total += int64(len(orders))
+	}
+	b, err := m.Engine("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := b.Table("shard_order_2").Count()
+	if err != nil || total+count != 30 || count == 0 {
+		t.Fatalf("orders not spread over shards, %d and %d, err %v", total, count, err)
+	}
+
+	// tenants have their own database, and routing prefers them
+	for _, tenant := range []string{"acme", "globex"} {
+		s, err := m.Context(WithShardKey(WithTenant(ctx, tenant), 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Sync2(&groupUser{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Insert(&groupUser{Name: tenant})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	acme, err := m.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []*groupUser{}
+	err = acme.Find(&users)
+	if err != nil || len(users) != 1 || users[0].Name != "acme" {
+		t.Fatalf("tenant data mixed %v, err %v", users, err)
+	}
+	if _, err = m.Tenant("../other"); err == nil {
+		t.Fatal("invalid tenant id accepted")
+	}
+	if _, err = m.Context(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	opened := len(m.Opened())
+	m.reap(time.Now())
+	if len(m.Opened()) != opened {
+		t.Fatal("engines in use closed")
+	}
+	m.reap(time.Now().Add(time.Hour))
+	if len(m.Opened()) != 0 {
+		t.Fatalf("idle engines %v not closed", m.Opened())
+	}
+	acme, err = m.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := acme.Count(&groupUser{}); err != nil || count != 1 {
+		t.Fatalf("reopened tenant count %d, err %v", count, err)
+	}
+}
+
+func TestManagerDo(t *testing.T) {
+	m, err := NewManager(&ManagerConfig{
+		Tenant: &EngineConfig{Type: "sqlite3", Uri: filepath.Join(t.TempDir(), "tenant_{tenant}.db"), LogLevel: "off"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	ctx := WithTenant(context.Background(), "acme")
+
+	// the engine held by Do survives a reap while idle between queries
+	err = m.Do(ctx, func(engine *xorm.Engine) error {
+		err := engine.Sync2(&groupUser{})
+		if err != nil {
+			return err
+		}
+		m.reap(time.Now().Add(time.Hour))
+		_, err = engine.Insert(&groupUser{Name: "acme"})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.reap(time.Now().Add(time.Hour))
+	if len(m.Opened()) != 0 {
+		t.Fatalf("released engines %v not closed", m.Opened())
+	}
+	err = m.Do(ctx, func(engine *xorm.Engine) error {
+		count, err := engine.Count(&groupUser{})
+		if err == nil && count != 1 {
+			t.Fatalf("reopened tenant count %d", count)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManagerIdleTimeout(t *testing.T) {
+	_, err := NewManager(&ManagerConfig{IdleTimeout: -time.Minute})
+	if err == nil {
+		t.Fatal("negative idle timeout accepted")
+	}
+}
+
+func TestManagerReplicas(t *testing.T) {
+	config := &EngineConfig{Type: "sqlite3", Uri: "default.db", Replicas: []ReplicaConfig{{Uri: "replica.db"}}}
+	_, err := NewManager(&ManagerConfig{Engines: map[string]*EngineConfig{"default": config}})
+	if err == nil {
+		t.Fatal("engine replicas accepted")
+	}
+	config.Uri = "tenant_{tenant}.db"
+	_, err = NewManager(&ManagerConfig{Tenant: config})
+	if err == nil {
+		t.Fatal("tenant engine replicas accepted")
+	}
+}
@@ -0,0 +1,192 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"xorm.io/xorm"
+	"xorm.io/xorm/contexts"
+
+	"go.yym.plus/zeus/pkg/log"
+)
+
+var (
+	metricsQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "zeus",
+		Subsystem: "db",
+		Name:      "query_duration_seconds",
+		Help:      "Latency of sql statements, until the first row for queries.",
+	}, []string{"db", "table", "operation"})
+	metricsQueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "zeus",
+		Subsystem: "db",
+		Name:      "query_errors_total",
+		Help:      "Number of failed sql statements.",
+	}, []string{"db", "table", "operation"})
+	metricsRowsAffected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "zeus",
+		Subsystem: "db",
+		Name:      "rows_affected_total",
+		Help:      "Number of rows affected by sql statements other than queries.",
+	}, []string{"db", "table", "operation"})
+)
+
+func init() {
+	prometheus.MustRegister(metricsQueryDuration, metricsQueryErrors, metricsRowsAffected)
+}
+
+var (
+	sqlCommentRe = regexp.MustCompile(`^(\s*(--[^\n]*\n|/\*(?s:.*?)\*/))*\s*`)
+	sqlTableRe   = map[string]*regexp.Regexp{
+		"select": regexp.MustCompile(`(?i)\sFROM\s+([^\s,()]+)`),
+		"delete": regexp.MustCompile(`(?i)\sFROM\s+([^\s,()]+)`),
+		"insert": regexp.MustCompile(`(?i)\sINTO\s+([^\s,()]+)`),
+		"update": regexp.MustCompile(`(?i)^UPDATE\s+([^\s,()]+)`),
+	}
+)
+
+// queryHook records the metrics of every statement and logs slow ones.
+type queryHook struct {
+	db        string
+	threshold time.Duration
+	args      string
+}
+
+type queryStartKey struct{}
+
+func newQueryHook(config *EngineConfig, engine *xorm.Engine) *queryHook {
+	return &queryHook{
+		db:        engine.Dialect().URI().DBName,
+		threshold: config.SlowQuery.Threshold,
+		args:      config.SlowQuery.Args,
+	}
+}
+
+func (self *queryHook) BeforeProcess(c *contexts.ContextHook) (context.Context, error) {
+	return c.Ctx, nil
+}
+
+func (self *queryHook) AfterProcess(c *contexts.ContextHook) error {
+	operation, table := parseStatement(c.SQL)
+	metricsQueryDuration.WithLabelValues(self.db, table, operation).Observe(c.ExecuteTime.Seconds())
+	if c.Err != nil {
+		metricsQueryErrors.WithLabelValues(self.db, table, operation).Inc()
+	} else if c.Result != nil {
+		if affected, err := c.Result.RowsAffected(); err == nil && affected > 0 {
+			metricsRowsAffected.WithLabelValues(self.db, table, operation).Add(float64(affected))
+		}
+	}
+	if self.threshold > 0 && c.ExecuteTime >= self.threshold {
+		kvs := []interface{}{"db", self.db, "sql", c.SQL, "elapsed", c.ExecuteTime}
+		switch self.args {
+		case "full":
+			kvs = append(kvs, "args", c.Args)
+		case "redacted":
+			kvs = append(kvs, "args", redactArgs(c.Args))
+		}
+		log.Ctx(c.Ctx).Warnw("slow query", kvs...)
+	}
+	// c.Err is reported by xorm, returning it would be reported twice
+	return nil
+}
+
+// parseStatement returns the lowercase operation of a statement and the table
+// it operates on, empty if unknown.
+func parseStatement(query string) (operation, table string) {
+	query = sqlCommentRe.ReplaceAllString(query, "")
+	end := strings.IndexFunc(query, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '('
+	})
+	if end < 0 {
+		end = len(query)
+	}
+	operation = strings.ToLower(query[:end])
+	if operation == "with" {
+		operation = "select"
+	}
+	re, ok := sqlTableRe[operation]
+	if !ok {
+		return operation, ""
+	}
+	match := re.FindStringSubmatch(query)
+	if match == nil {
+		return operation, ""
+	}
+	return operation, strings.Trim(match[1], "`\"[]")
+}
+
+// redactArgs keeps the numbers, bools, times and nulls of args and replaces
+// strings and bytes by their length, which may be personal data or secrets.
+func redactArgs(args []interface{}) []interface{} {
+	redacted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+			float32, float64, time.Time:
+			redacted[i] = v
+		case string:
+			redacted[i] = fmt.Sprintf("<string len=%d>", len(v))
+		case []byte:
+			redacted[i] = fmt.Sprintf("<bytes len=%d>", len(v))
+		default:
+			redacted[i] = fmt.Sprintf("<%T>", v)
+		}
+	}
+	return redacted
+}
+
+// statsCollector exports the connection pool stats of an engine.
+type statsCollector struct {
+	engine       *xorm.Engine
+	maxOpen      *prometheus.Desc
+	open         *prometheus.Desc
+	inUse        *prometheus.Desc
+	idle         *prometheus.Desc
+	waitCount    *prometheus.Desc
+	waitDuration *prometheus.Desc
+	closed       *prometheus.Desc
+}
+
+// NewStatsCollector returns a collector of the connection pool stats of engine,
+// labelled with db name, to be registered with prometheus.Register.
+func NewStatsCollector(name string, engine *xorm.Engine) prometheus.Collector {
+	desc := func(metric, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("zeus", "db", metric), help, nil, prometheus.Labels{"db": name})
+	}
+	return &statsCollector{
+		engine:       engine,
+		maxOpen:      desc("pool_max_open_connections", "Maximum number of open connections, 0 for unlimited."),
+		open:         desc("pool_open_connections", "Number of open connections, in use or idle."),
+		inUse:        desc("pool_in_use_connections", "Number of connections in use."),
+		idle:         desc("pool_idle_connections", "Number of idle connections."),
+		waitCount:    desc("pool_wait_count_total", "Number of connections waited for."),
+		waitDuration: desc("pool_wait_duration_seconds_total", "Time blocked waiting for a connection."),
+		closed:       desc("pool_closed_total", "Number of connections closed by the idle and lifetime limits."),
+	}
+}
+
+func (self *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- self.maxOpen
+	ch <- self.open
+	ch <- self.inUse
+	ch <- self.idle
+	ch <- self.waitCount
+	ch <- self.waitDuration
+	ch <- self.closed
+}
+
+func (self *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := self.engine.DB().Stats()
+	ch <- prometheus.MustNewConstMetric(self.maxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(self.open, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(self.inUse, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(self.idle, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(self.waitCount, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(self.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(self.closed, prometheus.CounterValue,
+		float64(stats.MaxIdleClosed+stats.MaxLifetimeClosed))
+}
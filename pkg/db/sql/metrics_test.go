@@ -0,0 +1,68 @@
+package sql
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseStatement(t *testing.T) {
+	for query, expect := range map[string][2]string{
+		"SELECT `id`, `name` FROM `user` WHERE id=?":                 {"select", "user"},
+		"select count(*) from \"order\" o join item i on 1=1":        {"select", "order"},
+		"/* trace */\n-- note\nINSERT INTO [user] (name) VALUES (?)": {"insert", "user"},
+		"UPDATE `user` SET `name` = ? WHERE id=?":                    {"update", "user"},
+		"DELETE FROM user_role WHERE user_id=?":                      {"delete", "user_role"},
+		"WITH t AS (SELECT 1) SELECT * FROM t":                       {"select", "t"},
+		"BEGIN TRANSACTION":                                          {"begin", ""},
+	} {
+		operation, table := parseStatement(query)
+		if operation != expect[0] || table != expect[1] {
+			t.Fatalf("%s parsed as %s %s", query, operation, table)
+		}
+	}
+}
+
+func TestQueryMetrics(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "metrics.db")
+	newSqliteEngine(t, file, "initial")
+	config := &EngineConfig{Type: "sqlite3", Uri: file, LogLevel: "off"}
+	config.SlowQuery.Threshold = time.Nanosecond
+	engine, err := NewEngine(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	db := engine.Dialect().URI().DBName
+	ctx := context.Background()
+
+	queries := testutil.ToFloat64(metricsQueryErrors.WithLabelValues(db, "group_user", "select"))
+	affected := testutil.ToFloat64(metricsRowsAffected.WithLabelValues(db, "group_user", "update"))
+	_, err = engine.Context(ctx).Where("id > ?", 0).Update(&groupUser{Name: "updated"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = engine.Context(ctx).Where("missing = ?", 1).Get(&groupUser{})
+	if err == nil {
+		t.Fatal("unknown column queried")
+	}
+	if n := testutil.ToFloat64(metricsRowsAffected.WithLabelValues(db, "group_user", "update")) - affected; n != 1 {
+		t.Fatalf("%v rows affected recorded", n)
+	}
+	if n := testutil.ToFloat64(metricsQueryErrors.WithLabelValues(db, "group_user", "select")) - queries; n != 1 {
+		t.Fatalf("%v errors recorded", n)
+	}
+
+	redacted := redactArgs([]interface{}{1, "secret", []byte("token"), nil, true})
+	if redacted[0] != 1 || redacted[1] != "<string len=6>" || redacted[2] != "<bytes len=5>" || redacted[3] != nil || redacted[4] != true {
+		t.Fatalf("unexpected redacted args %v", redacted)
+	}
+
+	if n := testutil.CollectAndCount(NewStatsCollector("test", engine)); n != 7 {
+		t.Fatalf("%d pool stats collected", n)
+	}
+}
@@ -1,6 +1,11 @@
 package sql
 
-import "github.com/iancoleman/strcase"
+import (
+	"strings"
+
+	"github.com/iancoleman/strcase"
+	"xorm.io/xorm/names"
+)
 
 type lowerCamelMapper struct {
 }
@@ -12,3 +17,29 @@ func (l lowerCamelMapper) Obj2Table(s string) string {
 func (l lowerCamelMapper) Table2Obj(s string) string {
 	return strcase.ToLowerCamel(s)
 }
+
+// shardTableMapper suffixes the sharded tables with the suffix of a shard.
+type shardTableMapper struct {
+	names.Mapper
+	tables map[string]bool
+	suffix string
+}
+
+func (self shardTableMapper) Obj2Table(s string) string {
+	return self.table(self.Mapper.Obj2Table(s))
+}
+
+// table returns the name of table in the shard.
+func (self shardTableMapper) table(table string) string {
+	if self.tables[table] {
+		return table + self.suffix
+	}
+	return table
+}
+
+func (self shardTableMapper) Table2Obj(s string) string {
+	if trimmed := strings.TrimSuffix(s, self.suffix); trimmed != s && self.tables[trimmed] {
+		s = trimmed
+	}
+	return self.Mapper.Table2Obj(s)
+}
@@ -0,0 +1,174 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
+)
+
+// PageResult is a page of rows with the total of all pages, serialized as
+// {"items":[...],"total":0,"page":1,"size":20,"hasNext":false}.
+type PageResult struct {
+	ExecResult `json:"-"`
+	Items      interface{} `json:"items"`
+	Total      int64       `json:"total"`
+	Page       int32       `json:"page"`
+	Size       int32       `json:"size"`
+	HasNext    bool        `json:"hasNext"`
+}
+
+const windowTotalColumn = "zeus_total"
+
+// windowSupport caches whether a MySQL server, by address, has window functions.
+var windowSupport sync.Map
+
+// FindPage finds page of size rows matching conds into rowsSlicePtr and counts
+// all matching rows, in two queries. Page starts from 1.
+func FindPage(s *xorm.Session, rowsSlicePtr interface{}, page, size int32, conds ...Cond) *PageResult {
+	if page < 1 {
+		page = 1
+	}
+	err := ApplyConds(s, append(conds, NewPagination(size, page))...)
+	if err != nil {
+		return newPageResult(rowsSlicePtr, 0, page, size, err)
+	}
+	total, err := s.FindAndCount(rowsSlicePtr)
+	return newPageResult(rowsSlicePtr, total, page, size, err)
+}
+
+// FindPageWindow is FindPage in one query, counting with COUNT(*) OVER() where
+// the database has window functions: PostgreSQL, SQL Server, MySQL 8, MariaDB
+// 10.2 and SQLite 3.25. Elsewhere, or for a page past the end, it counts with a
+// second query. Every query runs on a new session of engine with ctx. Conds
+// must not select columns.
+func FindPageWindow(ctx context.Context, engine xorm.EngineInterface, rowsSlicePtr interface{}, page, size int32, conds ...Cond) *PageResult {
+	if !supportsWindow(engine) {
+		return FindPage(engine.Context(ctx), rowsSlicePtr, page, size, conds...)
+	}
+	if page < 1 {
+		page = 1
+	}
+	rows := reflect.Indirect(reflect.ValueOf(rowsSlicePtr))
+	if rows.Kind() != reflect.Slice {
+		return newPageResult(rowsSlicePtr, 0, page, size, errors.New("page rows must be a pointer to a slice"))
+	}
+	elemType := rows.Type().Elem()
+	beanType := elemType
+	if beanType.Kind() == reflect.Ptr {
+		beanType = beanType.Elem()
+	}
+	// rows of the bean extended with the total column
+	rowType := reflect.StructOf([]reflect.StructField{
+		{Name: "Row", Type: beanType, Tag: `xorm:"extends"`},
+		{Name: "ZeusTotal", Type: reflect.TypeOf(int64(0)), Tag: reflect.StructTag(fmt.Sprintf("xorm:\"'%s'\"", windowTotalColumn))},
+	})
+	bean := reflect.New(beanType).Interface()
+	table := engine.Quote(engine.TableName(bean))
+	s := engine.Context(ctx)
+	s.Table(bean).Select(fmt.Sprintf("%s.*, COUNT(*) OVER() AS %s", table, windowTotalColumn))
+	err := ApplyConds(s, append(conds, NewPagination(size, page))...)
+	if err != nil {
+		return newPageResult(rowsSlicePtr, 0, page, size, err)
+	}
+	results := reflect.New(reflect.SliceOf(rowType))
+	err = s.Find(results.Interface())
+	if err != nil {
+		return newPageResult(rowsSlicePtr, 0, page, size, err)
+	}
+	results = results.Elem()
+	if results.Len() == 0 {
+		if page == 1 {
+			return newPageResult(rowsSlicePtr, 0, page, size, nil)
+		}
+		// no row to carry the total past the end
+		return FindPage(engine.Context(ctx), rowsSlicePtr, page, size, conds...)
+	}
+	for i := 0; i < results.Len(); i++ {
+		row := results.Index(i).Field(0)
+		if elemType.Kind() == reflect.Ptr {
+			ptr := reflect.New(beanType)
+			ptr.Elem().Set(row)
+			row = ptr
+		}
+		rows.Set(reflect.Append(rows, row))
+	}
+	total := results.Index(0).Field(1).Int()
+	return newPageResult(rowsSlicePtr, total, page, size, nil)
+}
+
+func newPageResult(rowsSlicePtr interface{}, total int64, page, size int32, err error) *PageResult {
+	items := reflect.Indirect(reflect.ValueOf(rowsSlicePtr))
+	// an empty page serializes as [] rather than null
+	if items.Kind() == reflect.Slice && items.IsNil() {
+		items.Set(reflect.MakeSlice(items.Type(), 0, 0))
+	}
+	result := &PageResult{
+		ExecResult: ExecResult{err},
+		Items:      items.Interface(),
+		Page:       page,
+		Size:       size,
+	}
+	if err == nil {
+		result.Total = total
+		result.HasNext = int64(page)*int64(size) < total
+	}
+	return result
+}
+
+func supportsWindow(engine xorm.EngineInterface) bool {
+	switch engine.Dialect().URI().DBType {
+	case schemas.POSTGRES, schemas.MSSQL:
+		return true
+	case schemas.SQLITE:
+		_, version, _ := sqlite3.Version()
+		return version >= 3025000
+	case schemas.MYSQL:
+		// engines of the same server, such as the tenants and shards of a
+		// Manager, share the answer
+		addr := ""
+		if primary := primaryOf(engine); primary != nil {
+			if config, err := mysql.ParseDSN(primary.DataSourceName()); err == nil {
+				addr = config.Net + "(" + config.Addr + ")"
+			}
+		}
+		if supported, ok := windowSupport.Load(addr); ok {
+			return supported.(bool)
+		}
+		var version string
+		_, err := engine.SQL("SELECT VERSION()").Get(&version)
+		if err != nil {
+			// retry the next time
+			return false
+		}
+		supported := mysqlWindowVersion(version)
+		if addr != "" {
+			windowSupport.Store(addr, supported)
+		}
+		return supported
+	}
+	return false
+}
+
+// mysqlWindowVersion reports whether a version like 8.0.21 or 10.4.13-MariaDB has
+// window functions.
+func mysqlWindowVersion(version string) bool {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	major, _ := strconv.Atoi(parts[0])
+	minor, _ := strconv.Atoi(parts[1])
+	if strings.Contains(strings.ToLower(version), "mariadb") {
+		return major > 10 || major == 10 && minor >= 2
+	}
+	return major >= 8
+}
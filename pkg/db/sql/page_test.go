@@ -0,0 +1,65 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestFindPage(t *testing.T) {
+	engine := newTxEngine(t)
+	defer engine.Close()
+	for i := 0; i < 4; i++ {
+		_, err := engine.Insert(&groupUser{Name: "user"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	if !supportsWindow(engine) {
+		t.Fatal("sqlite has window functions")
+	}
+
+	for name, find := range map[string]func(*testing.T, int32, interface{}) *PageResult{
+		"count": func(t *testing.T, page int32, users interface{}) *PageResult {
+			return FindPage(engine.Context(ctx), users, page, 2, NewEq("name", "user"), NewOrderBy("id"))
+		},
+		"window": func(t *testing.T, page int32, users interface{}) *PageResult {
+			return FindPageWindow(ctx, engine, users, page, 2, NewEq("name", "user"), NewOrderBy("id"))
+		},
+	} {
+		users := []*groupUser{}
+		result := find(t, 2, &users)
+		if result.HasError() || result.Total != 4 || len(users) != 2 || users[0].Id != 4 || result.HasNext {
+			t.Fatalf("%s: unexpected page %+v, err %v", name, result, result.Error())
+		}
+		values := []groupUser{}
+		result = find(t, 0, &values)
+		if result.HasError() || result.Page != 1 || !result.HasNext || values[1].Id != 3 {
+			t.Fatalf("%s: unexpected first page %+v, err %v", name, result, result.Error())
+		}
+		users = nil
+		result = find(t, 3, &users)
+		if result.HasError() || result.Total != 4 || len(users) != 0 {
+			t.Fatalf("%s: unexpected page past the end %+v, err %v", name, result, result.Error())
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := `{"items":[],"total":4,"page":3,"size":2,"hasNext":false}`; string(data) != expect {
+			t.Fatalf("%s: unexpected json %s", name, data)
+		}
+	}
+
+	for version, expect := range map[string]bool{
+		"5.7.31-log":      false,
+		"8.0.21":          true,
+		"10.1.48-MariaDB": false,
+		"10.4.13-MariaDB": true,
+	} {
+		if mysqlWindowVersion(version) != expect {
+			t.Fatalf("mysql %s window functions %v", version, !expect)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"xorm.io/xorm"
+	"xorm.io/xorm/schemas"
+
+	"go.yym.plus/zeus/pkg/log"
+)
+
+type txKey struct{}
+
+type txOptions struct {
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// TxOption configures WithTx.
+type TxOption func(o *txOptions)
+
+// WithTxRetries sets how many times a transaction failing by deadlock or
+// serialization is retried, 3 by default.
+func WithTxRetries(retries int) TxOption {
+	return func(o *txOptions) {
+		o.retries = retries
+	}
+}
+
+// WithTxBackoff sets the first retry delay, doubled on each retry up to max,
+// 10ms and 1s by default.
+func WithTxBackoff(backoff, max time.Duration) TxOption {
+	return func(o *txOptions) {
+		o.backoff = backoff
+		o.maxBackoff = max
+	}
+}
+
+// Ctx returns the context of the session, WithTx called with it joins the
+// transaction of the session.
+func (self *Session) Ctx() context.Context {
+	if self.ctx == nil {
+		return context.Background()
+	}
+	return self.ctx
+}
+
+// WithTx runs fn in a transaction on engine, committed if fn returns nil and
+// rolled back if fn returns an error or panics. Transactions failing by deadlock
+// or serialization are retried with backoff, so fn may run more than once.
+//
+// If ctx is the Ctx of a session in a transaction on the same engine, fn joins
+// it inside a savepoint instead, rolled back to on error without aborting the
+// outer transaction; retries are left to the outermost WithTx. On another
+// engine fn runs in a transaction of its own.
+func WithTx(ctx context.Context, engine xorm.EngineInterface, fn func(s *Session) error, opts ...TxOption) error {
+	if outer, ok := ctx.Value(txKey{}).(*Session); ok && outer.Engine() == primaryOf(engine) {
+		return outer.savepoint(fn)
+	}
+	options := &txOptions{
+		retries:    3,
+		backoff:    10 * time.Millisecond,
+		maxBackoff: time.Second,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	backoff := options.backoff
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, engine, fn)
+		if err == nil || attempt >= options.retries || !IsRetryable(err) {
+			return err
+		}
+		// jitter so deadlocked transactions don't collide again
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.WithError(err).Warnw("transaction conflict, retry", "attempt", attempt+1, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		backoff *= 2
+		if backoff > options.maxBackoff {
+			backoff = options.maxBackoff
+		}
+	}
+}
+
+// primaryOf returns the engine which the transactions of engine run on, nil
+// if unknown.
+func primaryOf(engine xorm.EngineInterface) *xorm.Engine {
+	switch e := engine.(type) {
+	case *xorm.Engine:
+		return e
+	case *EngineGroup:
+		return e.Master()
+	case *xorm.EngineGroup:
+		return e.Master()
+	}
+	return nil
+}
+
+// engineOf returns the engine db runs on, which is the primary of a group, nil
+// if unknown.
+func engineOf(db xorm.Interface) *xorm.Engine {
+	switch s := db.(type) {
+	case *xorm.Session:
+		return s.Engine()
+	case *Session:
+		return s.Engine()
+	case xorm.EngineInterface:
+		return primaryOf(s)
+	}
+	return nil
+}
+
+func runTx(ctx context.Context, engine xorm.EngineInterface, fn func(s *Session) error) (err error) {
+	xs := engine.NewSession()
+	defer xs.Close()
+	s := &Session{Session: xs}
+	s.ctx = context.WithValue(ctx, txKey{}, s)
+	xs.Context(s.ctx)
+	err = xs.Begin()
+	if err != nil {
+		return errors.WithMessage(err, "begin transaction")
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			rollback(xs.Rollback())
+			panic(p)
+		}
+	}()
+	err = fn(s)
+	if err != nil {
+		rollback(xs.Rollback())
+		return err
+	}
+	return xs.Commit()
+}
+
+func (self *Session) savepoint(fn func(s *Session) error) (err error) {
+	self.savepoints++
+	name := fmt.Sprintf("zeus_sp_%d", self.savepoints)
+	save, release, rollbackTo := "SAVEPOINT "+name, "RELEASE SAVEPOINT "+name, "ROLLBACK TO SAVEPOINT "+name
+	if self.Engine().Dialect().URI().DBType == schemas.MSSQL {
+		save, release, rollbackTo = "SAVE TRANSACTION "+name, "", "ROLLBACK TRANSACTION "+name
+	}
+	_, err = self.Exec(save)
+	if err != nil {
+		return errors.WithMessage(err, "create savepoint")
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_, rerr := self.Exec(rollbackTo)
+			rollback(rerr)
+			panic(p)
+		}
+	}()
+	err = fn(self)
+	if err != nil {
+		_, rerr := self.Exec(rollbackTo)
+		rollback(rerr)
+		return err
+	}
+	if release != "" {
+		_, err = self.Exec(release)
+		if err != nil {
+			return errors.WithMessage(err, "release savepoint")
+		}
+	}
+	return nil
+}
+
+func rollback(err error) {
+	if err != nil {
+		log.WithError(err).Errorw("transaction rollback failed")
+	}
+}
+
+// IsRetryable reports whether err is a deadlock or serialization failure, after
+// which the whole transaction can be retried.
+func IsRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// ER_LOCK_DEADLOCK
+		return mysqlErr.Number == 1213
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// serialization_failure, deadlock_detected
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	var mssqlErr mssql.Error
+	if errors.As(err, &mssqlErr) {
+		// chosen as deadlock victim
+		return mssqlErr.Number == 1205
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
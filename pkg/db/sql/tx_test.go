@@ -0,0 +1,163 @@
+package sql
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+	"xorm.io/xorm"
+)
+
+func newTxEngine(t *testing.T) *xorm.Engine {
+	file := filepath.Join(t.TempDir(), "tx.db")
+	newSqliteEngine(t, file, "initial")
+	engine, err := xorm.NewEngine("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+func countUsers(t *testing.T, engine *xorm.Engine) int64 {
+	count, err := engine.Count(&groupUser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestWithTx(t *testing.T) {
+	engine := newTxEngine(t)
+	defer engine.Close()
+	ctx := context.Background()
+	insert := func(s *Session) error {
+		_, err := s.Insert(&groupUser{Name: "tx"})
+		return err
+	}
+
+	err := WithTx(ctx, engine, insert)
+	if err != nil || countUsers(t, engine) != 2 {
+		t.Fatalf("commit failed, err %v", err)
+	}
+
+	failure := errors.New("failure")
+	err = WithTx(ctx, engine, func(s *Session) error {
+		if err := insert(s); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure || countUsers(t, engine) != 2 {
+		t.Fatalf("rollback on error failed, err %v", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic not propagated")
+			}
+		}()
+		WithTx(ctx, engine, func(s *Session) error {
+			if err := insert(s); err != nil {
+				return err
+			}
+			panic("failure")
+		})
+	}()
+	if countUsers(t, engine) != 2 {
+		t.Fatal("rollback on panic failed")
+	}
+}
+
+func TestWithTxNested(t *testing.T) {
+	engine := newTxEngine(t)
+	defer engine.Close()
+
+	err := WithTx(context.Background(), engine, func(s *Session) error {
+		if _, err := s.Insert(&groupUser{Name: "outer"}); err != nil {
+			return err
+		}
+		err := WithTx(s.Ctx(), engine, func(s *Session) error {
+			if _, err := s.Insert(&groupUser{Name: "inner"}); err != nil {
+				return err
+			}
+			return errors.New("failure")
+		})
+		if err == nil {
+			t.Fatal("nested error lost")
+		}
+		return WithTx(s.Ctx(), engine, func(s *Session) error {
+			_, err := s.Insert(&groupUser{Name: "released"})
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expect := range map[string]int64{"outer": 1, "inner": 0, "released": 1} {
+		count, err := engine.Count(&groupUser{Name: name})
+		if err != nil || count != expect {
+			t.Fatalf("%s count %d, err %v", name, count, err)
+		}
+	}
+}
+
+func TestWithTxOtherEngine(t *testing.T) {
+	engine := newTxEngine(t)
+	defer engine.Close()
+	other := newTxEngine(t)
+	defer other.Close()
+
+	failure := errors.New("failure")
+	err := WithTx(context.Background(), engine, func(s *Session) error {
+		err := WithTx(s.Ctx(), other, func(s *Session) error {
+			_, err := s.Insert(&groupUser{Name: "other"})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("unexpected err %v", err)
+	}
+	if countUsers(t, other) != 2 {
+		t.Fatal("transaction on another engine should commit on its own")
+	}
+}
+
+func TestWithTxRetry(t *testing.T) {
+	engine := newTxEngine(t)
+	defer engine.Close()
+
+	attempts := 0
+	err := WithTx(context.Background(), engine, func(s *Session) error {
+		attempts++
+		if _, err := s.Insert(&groupUser{Name: "retry"}); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return errors.WithMessage(&mysql.MySQLError{Number: 1213}, "update")
+		}
+		return nil
+	}, WithTxBackoff(time.Millisecond, time.Millisecond))
+	if err != nil || attempts != 2 || countUsers(t, engine) != 2 {
+		t.Fatalf("retry failed, attempts %d, err %v", attempts, err)
+	}
+
+	attempts = 0
+	err = WithTx(context.Background(), engine, func(s *Session) error {
+		attempts++
+		return &mysql.MySQLError{Number: 1213}
+	}, WithTxRetries(2), WithTxBackoff(time.Millisecond, time.Millisecond))
+	if !IsRetryable(err) || attempts != 3 {
+		t.Fatalf("unexpected attempts %d, err %v", attempts, err)
+	}
+	if IsRetryable(errors.New("failure")) {
+		t.Fatal("plain error is not retryable")
+	}
+}
@@ -0,0 +1,242 @@
+// Package feature evaluates feature flags kept in a conf source, so features are
+// toggled by editing the file or nacos config instead of restarting. Flags live
+// under a key of the config:
+//
+//	features:
+//	  new-checkout:
+//	    enabled: true
+//	    percentage: 20
+//	    rules:
+//	      - attribute: country
+//	        in: [CN, US]
+//	      - attribute: plan
+//	        notIn: [free]
+//
+// A flag is on for a subject when it is enabled, the subject matches every rule
+// and the subject key falls in the rollout percentage. Flag names are case
+// insensitive; quote names yaml reads as booleans, such as on and off.
+package feature
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"go.yym.plus/zeus/pkg/conf"
+	"go.yym.plus/zeus/pkg/log"
+	"go.yym.plus/zeus/pkg/utils/structs"
+)
+
+type Flag struct {
+	Enabled bool
+	// Percentage of subjects the flag is on for, by a stable hash of the flag
+	// name and subject key. Nil means all subjects.
+	Percentage *float64 `validate:"omitempty,min=0,max=100"`
+	Rules      []*Rule  `validate:"dive"`
+}
+
+// Rule matches subjects whose attribute is one of In, if set, and none of NotIn.
+type Rule struct {
+	Attribute string `validate:"required"`
+	In        []string
+	NotIn     []string
+}
+
+// Subject is who a flag is evaluated for, Key is usually the user id.
+type Subject struct {
+	Key        string
+	Attributes map[string]string
+}
+
+// Flags holds the flags loaded from the subtree at key of a config.
+type Flags struct {
+	key   string
+	flags atomic.Value
+}
+
+// Evaluator evaluates the flags of one snapshot for one subject, so a request
+// sees consistent flags even if the config changes meanwhile.
+type Evaluator struct {
+	flags   map[string]*Flag
+	subject *Subject
+}
+
+type contextKey struct{}
+
+// New returns empty flags loaded from key by Update.
+func New(key string) *Flags {
+	f := &Flags{
+		key: strings.ToLower(key),
+	}
+	f.flags.Store(map[string]*Flag{})
+	return f
+}
+
+// Watch loads the flags at key from the watcher and reloads them on every change.
+// Invalid changes are logged and the last good flags are kept.
+func Watch(w *conf.Watcher, key string) (*Flags, error) {
+	f := New(key)
+	err := f.Update(w.Viper())
+	if err != nil {
+		return nil, err
+	}
+	w.OnChange(func(v *viper.Viper) {
+		err := f.Update(v)
+		if err != nil {
+			log.WithError(err).Errorw("feature flags update rejected, keep last good flags", "key", key)
+		}
+	})
+	return f, nil
+}
+
+// Update decodes and validates the flags from v, on error the current flags are kept.
+func (self *Flags) Update(v *viper.Viper) error {
+	flags := map[string]*Flag{}
+	err := v.UnmarshalKey(self.key, &flags)
+	if err != nil {
+		return errors.WithMessage(err, "decode feature flags")
+	}
+	for name, flag := range flags {
+		if flag == nil {
+			flag = &Flag{}
+			flags[name] = flag
+		}
+		err = structs.Validate(flag)
+		if err != nil {
+			return errors.WithMessagef(err, "validate feature flag %s", name)
+		}
+	}
+	self.flags.Store(flags)
+	return nil
+}
+
+// Names returns the names of all flags, sorted.
+func (self *Flags) Names() []string {
+	flags := self.load()
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Enabled reports whether flag name is on for subject, unknown flags are off.
+func (self *Flags) Enabled(name string, subject *Subject) bool {
+	return self.For(subject).Enabled(name)
+}
+
+// For returns an evaluator of the current flags for subject.
+func (self *Flags) For(subject *Subject) *Evaluator {
+	if subject == nil {
+		subject = &Subject{}
+	}
+	return &Evaluator{
+		flags:   self.load(),
+		subject: subject,
+	}
+}
+
+func (self *Flags) load() map[string]*Flag {
+	return self.flags.Load().(map[string]*Flag)
+}
+
+// Enabled reports whether flag name is on, a nil evaluator has every flag off.
+func (self *Evaluator) Enabled(name string) bool {
+	if self == nil {
+		return false
+	}
+	flag, ok := self.flags[strings.ToLower(name)]
+	if !ok {
+		return false
+	}
+	return flag.evaluate(strings.ToLower(name), self.subject)
+}
+
+// All returns the evaluation of every flag.
+func (self *Evaluator) All() map[string]bool {
+	result := map[string]bool{}
+	if self == nil {
+		return result
+	}
+	for name, flag := range self.flags {
+		result[name] = flag.evaluate(name, self.subject)
+	}
+	return result
+}
+
+// Subject returns the subject the flags are evaluated for.
+func (self *Evaluator) Subject() *Subject {
+	if self == nil {
+		return nil
+	}
+	return self.subject
+}
+
+// NewContext returns a context carrying the evaluator.
+func NewContext(ctx context.Context, e *Evaluator) context.Context {
+	return context.WithValue(ctx, contextKey{}, e)
+}
+
+// FromContext returns the evaluator of the context, nil if there is none.
+func FromContext(ctx context.Context) *Evaluator {
+	e, _ := ctx.Value(contextKey{}).(*Evaluator)
+	return e
+}
+
+// Enabled reports whether flag name is on for the evaluator of ctx.
+func Enabled(ctx context.Context, name string) bool {
+	return FromContext(ctx).Enabled(name)
+}
+
+func (self *Flag) evaluate(name string, subject *Subject) bool {
+	if !self.Enabled {
+		return false
+	}
+	for _, rule := range self.Rules {
+		if !rule.match(subject) {
+			return false
+		}
+	}
+	if self.Percentage == nil || *self.Percentage >= 100 {
+		return true
+	}
+	if subject.Key == "" {
+		return false
+	}
+	return float64(bucket(name, subject.Key)) < *self.Percentage*100
+}
+
+func (self *Rule) match(subject *Subject) bool {
+	value, ok := subject.Attributes[self.Attribute]
+	if len(self.In) > 0 && (!ok || !contains(self.In, value)) {
+		return false
+	}
+	if ok && contains(self.NotIn, value) {
+		return false
+	}
+	return true
+}
+
+// bucket maps the subject key to one of 10000 buckets, salted with the flag
+// name so flags roll out to different subjects.
+func bucket(name, key string) uint32 {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%s", name, key)
+	return h.Sum32() % 10000
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package feature_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go.yym.plus/zeus/pkg/conf"
+	"go.yym.plus/zeus/pkg/feature"
+	"go.yym.plus/zeus/pkg/http/middleware"
+)
+
+const flagsConfig = `
+features:
+  always:
+    enabled: true
+  never:
+    enabled: false
+  half:
+    enabled: true
+    percentage: 50
+  targeted:
+    enabled: true
+    rules:
+      - attribute: country
+        in: [CN, US]
+      - attribute: plan
+        notIn: [free]
+`
+
+func watchFlags(t *testing.T, content string) (*feature.Flags, *conf.Watcher, func(string)) {
+	file := filepath.Join(t.TempDir(), "app.yml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(content)
+	w, err := conf.NewWatcher(&conf.Source{Type: "file", ContentType: "yaml", URI: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, err := feature.Watch(w, "features")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flags, w, write
+}
+
+func TestFlags(t *testing.T) {
+	flags, w, _ := watchFlags(t, flagsConfig)
+	defer w.Stop()
+
+	user := &feature.Subject{Key: "1", Attributes: map[string]string{"country": "CN", "plan": "pro"}}
+	if !flags.Enabled("always", nil) || flags.Enabled("never", user) || flags.Enabled("unknown", user) {
+		t.Fatal("unexpected boolean flags")
+	}
+	if !flags.Enabled("targeted", user) {
+		t.Fatal("targeted flag should be on")
+	}
+	for _, attributes := range []map[string]string{
+		{"country": "JP", "plan": "pro"},
+		{"country": "CN", "plan": "free"},
+		{"plan": "pro"},
+	} {
+		if flags.Enabled("targeted", &feature.Subject{Key: "1", Attributes: attributes}) {
+			t.Fatalf("targeted flag should be off for %v", attributes)
+		}
+	}
+
+	on := 0
+	for i := 0; i < 10000; i++ {
+		subject := &feature.Subject{Key: fmt.Sprint(i)}
+		enabled := flags.Enabled("half", subject)
+		if enabled != flags.Enabled("half", subject) {
+			t.Fatal("rollout not stable")
+		}
+		if enabled {
+			on++
+		}
+	}
+	if on < 4500 || on > 5500 {
+		t.Fatalf("rollout of 50%% enabled %d of 10000", on)
+	}
+	if flags.Enabled("half", &feature.Subject{}) {
+		t.Fatal("partial rollout needs a subject key")
+	}
+}
+
+func TestFlagsUpdate(t *testing.T) {
+	flags, w, write := watchFlags(t, flagsConfig)
+	defer w.Stop()
+	err := w.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("features:\n  never:\n    enabled: true\n")
+	deadline := time.Now().Add(3 * time.Second)
+	for !flags.Enabled("never", nil) {
+		if time.Now().After(deadline) {
+			t.Fatal("flags not updated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if flags.Enabled("always", nil) {
+		t.Fatal("removed flag should be off")
+	}
+
+	// invalid update keeps the last good flags
+	write("features:\n  never:\n    enabled: false\n    percentage: 120\n")
+	time.Sleep(300 * time.Millisecond)
+	if !flags.Enabled("never", nil) {
+		t.Fatal("invalid flags should be rejected")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	flags, w, _ := watchFlags(t, flagsConfig)
+	defer w.Stop()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(middleware.Feature(flags, func(c *gin.Context) *feature.Subject {
+		return &feature.Subject{
+			Key:        c.GetHeader("X-User"),
+			Attributes: map[string]string{"country": c.GetHeader("X-Country")},
+		}
+	}))
+	engine.GET("/", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"targeted": middleware.FeatureEnabled(c, "targeted"),
+			"context":  feature.Enabled(c.Request.Context(), "targeted"),
+			"always":   feature.FromContext(c.Request.Context()).Enabled("always"),
+		})
+	})
+
+	for country, expect := range map[string]string{
+		"US": `{"always":true,"context":true,"targeted":true}`,
+		"JP": `{"always":true,"context":false,"targeted":false}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-User", "1")
+		req.Header.Set("X-Country", country)
+		resp := httptest.NewRecorder()
+		engine.ServeHTTP(resp, req)
+		if resp.Body.String() != expect {
+			t.Fatalf("country %s: unexpected response %s", country, resp.Body.String())
+		}
+	}
+}
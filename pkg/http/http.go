@@ -19,6 +19,10 @@ type Config struct {
 	}
 }
 
+// ConfigSchema is the config schema of a server, for the application to
+// register under the key it chooses, like schema.Register("http", http.ConfigSchema).
+var ConfigSchema = Config{}
+
 type Engine struct {
 	*gin.Engine
 	config *Config
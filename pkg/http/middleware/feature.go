@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"go.yym.plus/zeus/pkg/feature"
+)
+
+// FeatureKey is the gin context key of the request's *feature.Evaluator.
+const FeatureKey = "feature"
+
+// Feature evaluates the flags for the subject of each request and exposes the
+// evaluator in the gin context under FeatureKey and in the request context, see
+// feature.FromContext. Without subject the client ip is the subject key.
+func Feature(flags *feature.Flags, subject func(c *gin.Context) *feature.Subject) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var s *feature.Subject
+		if subject != nil {
+			s = subject(c)
+		} else {
+			s = &feature.Subject{Key: c.ClientIP()}
+		}
+		e := flags.For(s)
+		c.Set(FeatureKey, e)
+		c.Request = c.Request.WithContext(feature.NewContext(c.Request.Context(), e))
+		c.Next()
+	}
+}
+
+// FeatureEnabled reports whether flag name is on for the request, false if the
+// Feature middleware is not installed.
+func FeatureEnabled(c *gin.Context, name string) bool {
+	e, _ := c.Value(FeatureKey).(*feature.Evaluator)
+	return e.Enabled(name)
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/segmentio/ksuid"
+
+	"go.yym.plus/zeus/pkg/log"
+)
+
+const (
+	// RequestIDHeader is the header carrying the request id, from the client or
+	// a proxy, or generated and echoed in the response.
+	RequestIDHeader = "X-Request-Id"
+	// RequestIDKey is the gin context key of the request id.
+	RequestIDKey = "requestId"
+)
+
+// version-traceid-parentid-flags of the w3c trace context
+var traceparentRe = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// RequestID tags the request context with its request id, and trace id from a
+// w3c traceparent header, so loggers from log.Ctx, including sql logs, can be
+// tied to the request.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = ksuid.New().String()
+		}
+		c.Set(RequestIDKey, id)
+		c.Header(RequestIDHeader, id)
+		kvs := []interface{}{"requestId", id}
+		if match := traceparentRe.FindStringSubmatch(c.GetHeader("traceparent")); match != nil {
+			kvs = append(kvs, "traceId", match[1])
+		}
+		c.Request = c.Request.WithContext(log.NewContext(c.Request.Context(), kvs...))
+		c.Next()
+	}
+}
@@ -0,0 +1,38 @@
+package log
+
+import "context"
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the key value pairs kvs in addition to
+// those of ctx, such as request and trace ids, logged by the loggers of Ctx.
+func NewContext(ctx context.Context, kvs ...interface{}) context.Context {
+	fields := ContextFields(ctx)
+	merged := make([]interface{}, 0, len(fields)+len(kvs))
+	merged = append(merged, fields...)
+	merged = append(merged, kvs...)
+	return context.WithValue(ctx, contextKey{}, merged)
+}
+
+// ContextFields returns the key value pairs of ctx from NewContext.
+func ContextFields(ctx context.Context) []interface{} {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(contextKey{}).([]interface{})
+	return fields
+}
+
+// Ctx returns a logger with the fields of ctx.
+func (self *Logger) Ctx(ctx context.Context) *Logger {
+	fields := ContextFields(ctx)
+	if len(fields) == 0 {
+		return self
+	}
+	return self.With(fields...)
+}
+
+// Ctx returns the default logger with the fields of ctx.
+func Ctx(ctx context.Context) *Logger {
+	return defaultLogger.Ctx(ctx)
+}
@@ -0,0 +1,22 @@
+package log_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"go.yym.plus/zeus/pkg/log"
+)
+
+func TestCloneFilePaths(t *testing.T) {
+	dir := t.TempDir()
+	disabled := false
+	config := &log.Config{}
+	config.Console.Enable = &disabled
+	config.File.Paths = map[string]string{"error": filepath.Join(dir, "error.log")}
+	logger := log.New(config)
+	clone := logger.Clone()
+	clone.Config().File.Paths["info"] = filepath.Join(dir, "info.log")
+	if _, ok := logger.Config().File.Paths["info"]; ok {
+		t.Fatal("clone shares the file paths of its parent")
+	}
+}
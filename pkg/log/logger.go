@@ -53,6 +53,10 @@ type Config struct {
 	}
 }
 
+// ConfigSchema is the config schema of a logger, for the application to
+// register under the key it chooses, like schema.Register("log", log.ConfigSchema).
+var ConfigSchema = Config{}
+
 // New returns a Logger instance.
 func New(config *Config) *Logger {
 
@@ -92,8 +96,16 @@ func New(config *Config) *Logger {
 	return l
 }
 
+// Clone returns a new logger of a copy of the config, whose level is set
+// independently.
 func (self *Logger) Clone() *Logger {
-	return New(self.config)
+	config := *self.config
+	// fileCore fills in Paths, the clone must not write to the map of self
+	config.File.Paths = make(map[string]string, len(self.config.File.Paths))
+	for level, path := range self.config.File.Paths {
+		config.File.Paths[level] = path
+	}
+	return New(&config)
 }
 
 func (self *Logger) consoleCore() zapcore.Core {
@@ -329,6 +341,14 @@ func (self *Duration) UnmarshalJSON(bytes []byte) error {
 	return nil
 }
 
+func (self *Duration) UnmarshalText(text []byte) error {
+	return self.UnmarshalJSON(text)
+}
+
+func (self *Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(*self).String()), nil
+}
+
 func (self *Duration) Value() time.Duration {
 	return time.Duration(*self)
 }
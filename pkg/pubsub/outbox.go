@@ -0,0 +1,568 @@
+package pubsub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+	"github.com/segmentio/ksuid"
+
+	"go.yym.plus/zeus/pkg/log"
+)
+
+// Outbox keys are
+//
+//	"push_" | version(1 byte) | seq(8 bytes big endian) | uvarint(len(topic)) | topic | uuid
+//
+// so iterating the prefix yields pushes in enqueue order and topics may contain any byte.
+// Keys written before the versioned format are "push_<topic>:<uuid>" and are
+// migrated once when the outbox is opened.
+const (
+	pushPrefix       = "push_"
+	pushKeyVersion   = byte(1)
+	pushSeqKey       = "meta_push_seq"
+	pushVersionKey   = "meta_push_version"
+	pushSeqBandwidth = 100
+)
+
+// Outbox gives access to the AsyncPub messages persisted in badger which have not
+// been published yet. It works on a bare *badger.DB so it can be used offline.
+type Outbox struct {
+	db  *badger.DB
+	seq *badger.Sequence
+}
+
+// PendingPush is an outbox entry, also the json line format of Export/Import.
+type PendingPush struct {
+	Seq        uint64            `json:"seq"`
+	Topic      string            `json:"topic"`
+	UUID       string            `json:"uuid"`
+	EnqueuedAt time.Time         `json:"enqueuedAt"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Payload    []byte            `json:"payload"`
+}
+
+type pushRecord struct {
+	Topic      string           `json:"topic"`
+	EnqueuedAt time.Time        `json:"enqueuedAt"`
+	Message    *message.Message `json:"message"`
+}
+
+// NewOutbox opens the outbox of the db, migrating legacy keys if needed.
+// Close must be called to release the sequence lease.
+func NewOutbox(db *badger.DB) (*Outbox, error) {
+	seq, err := db.GetSequence([]byte(pushSeqKey), pushSeqBandwidth)
+	if err != nil {
+		return nil, errors.WithMessage(err, "get push sequence")
+	}
+	outbox := &Outbox{db: db, seq: seq}
+	err = outbox.migrate()
+	if err != nil {
+		seq.Release()
+		return nil, errors.WithMessage(err, "migrate push keys")
+	}
+	return outbox, nil
+}
+
+func (self *Outbox) Close() error {
+	return self.seq.Release()
+}
+
+func encodePushKey(seq uint64, topic string, uuid string) []byte {
+	key := make([]byte, 0, len(pushPrefix)+1+8+binary.MaxVarintLen64+len(topic)+len(uuid))
+	key = append(key, pushPrefix...)
+	key = append(key, pushKeyVersion)
+	var buf [binary.MaxVarintLen64]byte
+	binary.BigEndian.PutUint64(buf[:8], seq)
+	key = append(key, buf[:8]...)
+	n := binary.PutUvarint(buf[:], uint64(len(topic)))
+	key = append(key, buf[:n]...)
+	key = append(key, topic...)
+	key = append(key, uuid...)
+	return key
+}
+
+func decodePushKey(key []byte) (seq uint64, topic string, uuid string, err error) {
+	if !isVersionedPushKey(key) {
+		return 0, "", "", fmt.Errorf("push key version invalid")
+	}
+	remain := key[len(pushPrefix)+1:]
+	if len(remain) < 8 {
+		return 0, "", "", fmt.Errorf("push key seq invalid")
+	}
+	seq = binary.BigEndian.Uint64(remain[:8])
+	remain = remain[8:]
+	size, n := binary.Uvarint(remain)
+	if n <= 0 || uint64(len(remain)-n) < size {
+		return 0, "", "", fmt.Errorf("push key topic invalid")
+	}
+	remain = remain[n:]
+	return seq, string(remain[:size]), string(remain[size:]), nil
+}
+
+func isVersionedPushKey(key []byte) bool {
+	return len(key) > len(pushPrefix) && string(key[:len(pushPrefix)]) == pushPrefix && key[len(pushPrefix)] == pushKeyVersion
+}
+
+// decodeLegacyPushKey splits "push_<topic>:<uuid>", uuids never contain ':'
+// so the last one separates them.
+func decodeLegacyPushKey(key []byte) (topic string, uuid string) {
+	remain := string(key[len(pushPrefix):])
+	index := strings.LastIndex(remain, ":")
+	if index < 0 {
+		return remain, ""
+	}
+	return remain[:index], remain[index+1:]
+}
+
+func encodePushRecord(topic string, msg *message.Message, enqueuedAt time.Time) ([]byte, error) {
+	return json.Marshal(&pushRecord{
+		Topic:      topic,
+		EnqueuedAt: enqueuedAt,
+		Message:    msg,
+	})
+}
+
+// decodePushRecord decodes an outbox value, values written before the record
+// format are a bare message.
+func decodePushRecord(value []byte) (*pushRecord, error) {
+	record := pushRecord{}
+	err := json.Unmarshal(value, &record)
+	if err != nil {
+		return nil, err
+	}
+	if record.Message != nil {
+		return &record, nil
+	}
+	msg := message.Message{}
+	err = json.Unmarshal(value, &msg)
+	if err != nil {
+		return nil, err
+	}
+	return &pushRecord{Message: &msg}, nil
+}
+
+func (self *pushRecord) pending(seq uint64, topic string) *PendingPush {
+	metadata := map[string]string{}
+	for k, v := range self.Message.Metadata {
+		metadata[k] = v
+	}
+	return &PendingPush{
+		Seq:        seq,
+		Topic:      topic,
+		UUID:       self.Message.UUID,
+		EnqueuedAt: self.EnqueuedAt,
+		Metadata:   metadata,
+		Payload:    self.Message.Payload,
+	}
+}
+
+func (self *PendingPush) key() []byte {
+	return encodePushKey(self.Seq, self.Topic, self.UUID)
+}
+
+func (self *PendingPush) Age() time.Duration {
+	if self.EnqueuedAt.IsZero() {
+		return 0
+	}
+	return time.Since(self.EnqueuedAt)
+}
+
+func (self *PendingPush) message() *message.Message {
+	msg := message.NewMessage(self.UUID, self.Payload)
+	for k, v := range self.Metadata {
+		msg.Metadata.Set(k, v)
+	}
+	return msg
+}
+
+func (self *PendingPush) pushItem() *PushItem {
+	return &PushItem{
+		seq:   self.Seq,
+		topic: self.Topic,
+		msg:   &Message{original: self.message()},
+	}
+}
+
+// migrate rewrites legacy keys to the versioned format once, assigning
+// sequence numbers by enqueue time.
+func (self *Outbox) migrate() error {
+	done := false
+	err := self.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(pushVersionKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		done = err == nil
+		return err
+	})
+	if err != nil || done {
+		return err
+	}
+
+	type legacy struct {
+		key    []byte
+		record *pushRecord
+	}
+	legacies := []*legacy{}
+	prefix := []byte(pushPrefix)
+	err = self.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			if isVersionedPushKey(key) {
+				continue
+			}
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			record, err := decodePushRecord(value)
+			if err != nil {
+				return errors.WithMessagef(err, "decode legacy push %q", key)
+			}
+			if record.Topic == "" {
+				record.Topic, _ = decodeLegacyPushKey(key)
+			}
+			if record.EnqueuedAt.IsZero() {
+				// bare messages have no enqueue time, take the creation time of
+				// their ksuid rather than the key order
+				if id, err := ksuid.Parse(record.Message.UUID); err == nil {
+					record.EnqueuedAt = id.Time()
+				}
+			}
+			legacies = append(legacies, &legacy{key: key, record: record})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(legacies, func(i, j int) bool {
+		return legacies[i].record.EnqueuedAt.Before(legacies[j].record.EnqueuedAt)
+	})
+
+	wb := self.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, l := range legacies {
+		seq, err := self.seq.Next()
+		if err != nil {
+			return err
+		}
+		data, err := encodePushRecord(l.record.Topic, l.record.Message, l.record.EnqueuedAt)
+		if err != nil {
+			return err
+		}
+		err = wb.Set(encodePushKey(seq, l.record.Topic, l.record.Message.UUID), data)
+		if err != nil {
+			return err
+		}
+		err = wb.Delete(l.key)
+		if err != nil {
+			return err
+		}
+	}
+	err = wb.Set([]byte(pushVersionKey), []byte{pushKeyVersion})
+	if err != nil {
+		return err
+	}
+	err = wb.Flush()
+	if err != nil {
+		return err
+	}
+	if len(legacies) > 0 {
+		log.Infow("migrated legacy push keys", "count", len(legacies))
+	}
+	return nil
+}
+
+// Add stores a push at the tail of the outbox.
+func (self *Outbox) Add(topic string, msg *message.Message) (*PendingPush, error) {
+	seq, err := self.seq.Next()
+	if err != nil {
+		return nil, err
+	}
+	pending := &PendingPush{
+		Seq:        seq,
+		Topic:      topic,
+		UUID:       msg.UUID,
+		EnqueuedAt: time.Now(),
+	}
+	data, err := encodePushRecord(topic, msg, pending.EnqueuedAt)
+	if err != nil {
+		return nil, err
+	}
+	err = self.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(pending.key(), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func (self *Outbox) Delete(seq uint64, topic string, uuid string) error {
+	return self.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(encodePushKey(seq, topic, uuid))
+	})
+}
+
+// List returns pending pushes of the topic in enqueue order, or of every topic
+// if topic is empty.
+func (self *Outbox) List(topic string) ([]*PendingPush, error) {
+	prefix := append([]byte(pushPrefix), pushKeyVersion)
+	items := []*PendingPush{}
+	err := self.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			pending, err := self.decode(it.Item())
+			if err != nil {
+				return err
+			}
+			if topic != "" && pending.Topic != topic {
+				continue
+			}
+			items = append(items, pending)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// Purge deletes the pending pushes with the seqs, returns the deleted ones.
+func (self *Outbox) Purge(seqs ...uint64) ([]*PendingPush, error) {
+	purged := []*PendingPush{}
+	err := self.db.Update(func(txn *badger.Txn) error {
+		for _, seq := range seqs {
+			pending, err := self.get(txn, seq)
+			if err != nil {
+				return err
+			}
+			if pending == nil {
+				continue
+			}
+			err = txn.Delete(pending.key())
+			if err != nil {
+				return err
+			}
+			purged = append(purged, pending)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+// Requeue moves the pending pushes with the seqs to the tail of the outbox by
+// giving them new seqs, returns the requeued ones.
+func (self *Outbox) Requeue(seqs ...uint64) ([]*PendingPush, error) {
+	requeued := []*PendingPush{}
+	now := time.Now()
+	err := self.db.Update(func(txn *badger.Txn) error {
+		for _, seq := range seqs {
+			pending, err := self.get(txn, seq)
+			if err != nil {
+				return err
+			}
+			if pending == nil {
+				continue
+			}
+			err = txn.Delete(pending.key())
+			if err != nil {
+				return err
+			}
+			pending.Seq, err = self.seq.Next()
+			if err != nil {
+				return err
+			}
+			pending.EnqueuedAt = now
+			data, err := encodePushRecord(pending.Topic, pending.message(), now)
+			if err != nil {
+				return err
+			}
+			err = txn.Set(pending.key(), data)
+			if err != nil {
+				return err
+			}
+			requeued = append(requeued, pending)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return requeued, nil
+}
+
+// Export writes pending pushes of the topic as json lines.
+func (self *Outbox) Export(w io.Writer, topic string) (int, error) {
+	items, err := self.List(topic)
+	if err != nil {
+		return 0, err
+	}
+	encoder := json.NewEncoder(w)
+	for i, item := range items {
+		err = encoder.Encode(item)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(items), nil
+}
+
+// Import reads json lines written by Export and appends them to the outbox in
+// line order with new seqs.
+func (self *Outbox) Import(r io.Reader) ([]*PendingPush, error) {
+	items := []*PendingPush{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		item := PendingPush{}
+		err := json.Unmarshal([]byte(line), &item)
+		if err != nil {
+			return nil, errors.WithMessage(err, "decode push line")
+		}
+		if item.Topic == "" || item.UUID == "" {
+			return nil, fmt.Errorf("push line invalid, topic and uuid required")
+		}
+		if item.EnqueuedAt.IsZero() {
+			item.EnqueuedAt = time.Now()
+		}
+		items = append(items, &item)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	err := self.db.Update(func(txn *badger.Txn) error {
+		for _, item := range items {
+			seq, err := self.seq.Next()
+			if err != nil {
+				return err
+			}
+			item.Seq = seq
+			data, err := encodePushRecord(item.Topic, item.message(), item.EnqueuedAt)
+			if err != nil {
+				return err
+			}
+			err = txn.Set(item.key(), data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// get finds the pending push by seq, keys are ordered by seq so seeking to it
+// is enough. Returns nil if not found.
+func (self *Outbox) get(txn *badger.Txn, seq uint64) (*PendingPush, error) {
+	prefix := encodePushKey(seq, "", "")
+	prefix = prefix[:len(pushPrefix)+1+8]
+	opt := badger.DefaultIteratorOptions
+	opt.Prefix = prefix
+	it := txn.NewIterator(opt)
+	defer it.Close()
+	it.Seek(prefix)
+	if !it.ValidForPrefix(prefix) {
+		return nil, nil
+	}
+	return self.decode(it.Item())
+}
+
+func (self *Outbox) decode(item *badger.Item) (*PendingPush, error) {
+	key := item.KeyCopy(nil)
+	seq, topic, _, err := decodePushKey(key)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "decode push key %q", key)
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	record, err := decodePushRecord(value)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "decode push %d", seq)
+	}
+	return record.pending(seq, topic), nil
+}
+
+func (self *Hub) Outbox() *Outbox {
+	return self.outbox
+}
+
+func (self *Hub) ListPending(topic string) ([]*PendingPush, error) {
+	return self.outbox.List(topic)
+}
+
+// PurgePending deletes pending pushes and drops them from the in-memory queue.
+// Pushes being published are skipped, so they are not reported purged.
+func (self *Hub) PurgePending(seqs ...uint64) ([]*PendingPush, error) {
+	taken, idle := self.pushBuffer.Take(seqs)
+	purged, err := self.outbox.Purge(idle...)
+	if err != nil {
+		self.pushBuffer.PushFront(taken...)
+		return nil, err
+	}
+	return purged, nil
+}
+
+// RequeuePending moves pending pushes to the tail of the queue. Pushes being
+// published are skipped, so they are not published twice.
+func (self *Hub) RequeuePending(seqs ...uint64) ([]*PendingPush, error) {
+	taken, idle := self.pushBuffer.Take(seqs)
+	requeued, err := self.outbox.Requeue(idle...)
+	if err != nil {
+		self.pushBuffer.PushFront(taken...)
+		return nil, err
+	}
+	items := make([]*PushItem, 0, len(requeued))
+	for _, pending := range requeued {
+		items = append(items, pending.pushItem())
+	}
+	return requeued, self.pushBuffer.Push(items...)
+}
+
+// ImportPending imports pending pushes exported from another host and queues them.
+func (self *Hub) ImportPending(r io.Reader) ([]*PendingPush, error) {
+	imported, err := self.outbox.Import(r)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*PushItem, 0, len(imported))
+	for _, pending := range imported {
+		items = append(items, pending.pushItem())
+	}
+	return imported, self.pushBuffer.Push(items...)
+}
+
+func containsSeq(seqs []uint64, seq uint64) bool {
+	for _, s := range seqs {
+		if s == seq {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/dgraph-io/badger/v2"
+	"github.com/segmentio/ksuid"
+)
+
+func openDB(t *testing.T, dir string) *badger.DB {
+	opt := badger.DefaultOptions(dir)
+	if dir == "" {
+		opt = opt.WithInMemory(true)
+	}
+	opt.Logger = nil
+	db, err := badger.Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newMemoryDB(t *testing.T) *badger.DB {
+	db := openDB(t, "")
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+// newOfflineHub returns a hub without publisher/subscriber, recovering the outbox of db.
+func newOfflineHub(t *testing.T, db *badger.DB) *Hub {
+	hub := &Hub{
+		conf: &Config{},
+		db:   db,
+		pushBuffer: &Buffer{
+			cond: sync.NewCond(&sync.Mutex{}),
+		},
+		schemas: map[string]Schema{},
+	}
+	var err error
+	hub.outbox, err = NewOutbox(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hub.loadUnFinishPush(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hub
+}
+
+func bufferedPayloads(hub *Hub) []string {
+	payloads := []string{}
+	for _, item := range hub.pushBuffer.items {
+		payloads = append(payloads, string(item.msg.Payload()))
+	}
+	return payloads
+}
+
+func asyncPub(t *testing.T, hub *Hub, topic string, payload string) {
+	msg := NewMessage()
+	msg.SetPayloadData([]byte(payload))
+	if err := hub.AsyncPub(topic, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushKey(t *testing.T) {
+	key := encodePushKey(42, "a:b:c", "uuid")
+	seq, topic, uuid, err := decodePushKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 42 || topic != "a:b:c" || uuid != "uuid" {
+		t.Fatalf("decode mismatch %d %s %s", seq, topic, uuid)
+	}
+	if bytes.Compare(encodePushKey(255, "z", "u"), encodePushKey(256, "a", "u")) >= 0 {
+		t.Fatal("keys must sort by seq")
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	hub := newOfflineHub(t, newMemoryDB(t))
+	for _, topic := range []string{"a", "b", "a"} {
+		asyncPub(t, hub, topic, topic)
+	}
+
+	items, err := hub.ListPending("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expect 2 pending of topic a, got %d", len(items))
+	}
+
+	purged, err := hub.PurgePending(items[0].Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || len(hub.pushBuffer.items) != 2 {
+		t.Fatalf("purge failed, purged %d, buffered %d", len(purged), len(hub.pushBuffer.items))
+	}
+
+	requeued, err := hub.RequeuePending(items[1].Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requeued) != 1 || requeued[0].Seq <= items[1].Seq || hub.pushBuffer.items[1].seq != requeued[0].Seq {
+		t.Fatal("requeued push should be at the tail of the buffer")
+	}
+
+	buf := bytes.Buffer{}
+	n, err := hub.Outbox().Export(&buf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expect export 2, got %d", n)
+	}
+
+	other, err := NewOutbox(newMemoryDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	imported, err := other.Import(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := other.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 2 || len(all) != 2 || string(all[0].Payload) != "b" || string(all[1].Payload) != "a" {
+		t.Fatal("import mismatch")
+	}
+}
+
+func TestOutboxInFlight(t *testing.T) {
+	hub := newOfflineHub(t, newMemoryDB(t))
+	defer hub.outbox.Close()
+	asyncPub(t, hub, "a", "m0")
+	asyncPub(t, hub, "a", "m1")
+
+	// popped by runAsyncPub but not published yet
+	item, err := hub.pushBuffer.Pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	purged, err := hub.PurgePending(item.seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requeued, err := hub.RequeuePending(item.seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 0 || len(requeued) != 0 {
+		t.Fatal("in flight push should be skipped")
+	}
+	items, err := hub.ListPending("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Seq != item.seq || len(hub.pushBuffer.items) != 1 {
+		t.Fatal("in flight push should stay in the outbox")
+	}
+
+	hub.pushBuffer.Done(item)
+	purged, err = hub.PurgePending(item.seq, items[1].Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 2 || len(hub.pushBuffer.items) != 0 {
+		t.Fatalf("purge failed, purged %d, buffered %d", len(purged), len(hub.pushBuffer.items))
+	}
+}
+
+func TestOutboxRestartOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openDB(t, dir)
+	hub := newOfflineHub(t, db)
+	expected := []string{}
+	for i := 0; i < 5; i++ {
+		payload := fmt.Sprintf("m%d", i)
+		asyncPub(t, hub, "topic:with:colon", payload)
+		expected = append(expected, payload)
+	}
+	// crash: the sequence lease is never released
+	db.Close()
+
+	db = openDB(t, dir)
+	hub = newOfflineHub(t, db)
+	if got := bufferedPayloads(hub); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("recovered order %v, expect %v", got, expected)
+	}
+	for _, item := range hub.pushBuffer.items {
+		if item.topic != "topic:with:colon" {
+			t.Fatalf("recovered topic %s", item.topic)
+		}
+	}
+	asyncPub(t, hub, "other", "m5")
+	expected = append(expected, "m5")
+	hub.outbox.Close()
+	db.Close()
+
+	db = openDB(t, dir)
+	defer db.Close()
+	hub = newOfflineHub(t, db)
+	defer hub.outbox.Close()
+	if got := bufferedPayloads(hub); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("recovered order %v, expect %v", got, expected)
+	}
+}
+
+func TestOutboxMigrateLegacyKeys(t *testing.T) {
+	db := newMemoryDB(t)
+	now := time.Now()
+	err := db.Update(func(txn *badger.Txn) error {
+		// pre record format: bare message values, ordered by their ksuid only
+		for i, topic := range []string{"z", "a", "z", "a"} {
+			id, err := ksuid.NewRandomWithTime(now.Add(time.Duration(i-10) * time.Second))
+			if err != nil {
+				return err
+			}
+			uuid := id.String()
+			bare, _ := json.Marshal(message.NewMessage(uuid, []byte(fmt.Sprintf("b%d", i))))
+			if err := txn.Set([]byte("push_"+topic+":"+uuid), bare); err != nil {
+				return err
+			}
+		}
+		for i, topic := range []string{"b:colon", "a"} {
+			uuid := fmt.Sprintf("uuid%d", i+1)
+			data, _ := encodePushRecord(topic, message.NewMessage(uuid, []byte(fmt.Sprintf("m%d", i+1))), now.Add(time.Duration(i)*time.Second))
+			if err := txn.Set([]byte("push_"+topic+":"+uuid), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := newOfflineHub(t, db)
+	if got := fmt.Sprint(bufferedPayloads(hub)); got != "[b0 b1 b2 b3 m1 m2]" {
+		t.Fatalf("migrated order %s", got)
+	}
+	items, err := hub.ListPending("b:colon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].UUID != "uuid1" {
+		t.Fatal("legacy topic with colon not migrated")
+	}
+	hub.outbox.Close()
+
+	// migration runs once, a second open must not touch versioned keys
+	outbox, err := NewOutbox(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+	all, err := outbox.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 6 || all[0].Seq != items[0].Seq-4 {
+		t.Fatal("migrated keys changed on reopen")
+	}
+}
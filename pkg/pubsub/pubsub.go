@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
@@ -15,6 +14,7 @@ import (
 	"github.com/mitchellh/mapstructure"
 	"github.com/segmentio/ksuid"
 	"go.yym.plus/zeus/pkg/log"
+	"go.yym.plus/zeus/pkg/utils/structs"
 	"google.golang.org/api/option"
 )
 
@@ -26,17 +26,26 @@ type Hub struct {
 	logger      watermill.LoggerAdapter
 	db          *badger.DB
 	pushBuffer  *Buffer
+	outbox      *Outbox
+	schemas     map[string]Schema
+	schemaLock  sync.RWMutex
 }
 
 type Config struct {
-	Type        string
-	GroupID     string
-	TopicPrefix string
-	Debug       bool
-	Setting     map[string]interface{}
+	Type             string
+	GroupID          string
+	TopicPrefix      string
+	DeadLetterSuffix string `default:"dead_letter"`
+	Debug            bool
+	Setting          map[string]interface{}
 }
 
+// ConfigSchema is the config schema of a hub, for the application to register
+// under the key it chooses, like schema.Register("pubsub", pubsub.ConfigSchema).
+var ConfigSchema = Config{}
+
 type PushItem struct {
+	seq   uint64
 	topic string
 	msg   *Message
 }
@@ -45,6 +54,7 @@ type Buffer struct {
 	cond     *sync.Cond
 	capacity int
 	items    []*PushItem
+	inflight map[uint64]bool
 	closed   bool
 }
 
@@ -80,6 +90,10 @@ func newMessage(uuid string, payload []byte) *Message {
 }
 
 func newHub(conf *Config, db *badger.DB) (*Hub, error) {
+	err := structs.SetDefaults(conf)
+	if err != nil {
+		return nil, err
+	}
 	hub := Hub{
 		conf:   conf,
 		logger: watermill.NewStdLogger(conf.Debug, false),
@@ -89,9 +103,10 @@ func newHub(conf *Config, db *badger.DB) (*Hub, error) {
 			capacity: 1000,
 			closed:   false,
 		},
+		schemas: map[string]Schema{},
 	}
 
-	err := hub.init()
+	err = hub.init()
 	if err != nil {
 		return nil, err
 	}
@@ -101,21 +116,28 @@ func newHub(conf *Config, db *badger.DB) (*Hub, error) {
 type Handler func(msg *Message)
 
 func (self *Hub) Pub(topic string, msg *Message) error {
+	err := self.validate(topic, msg)
+	if err != nil {
+		return err
+	}
+	return self.publish(topic, msg)
+}
+
+func (self *Hub) publish(topic string, msg *Message) error {
 	return self.publisher.Publish(self.conf.TopicPrefix+"_"+topic, msg.original)
 }
 
 func (self *Hub) AsyncPub(topic string, msg *Message) error {
-	err := self.db.Update(func(txn *badger.Txn) error {
-		data, err := json.Marshal(msg.original)
-		if err != nil {
-			return err
-		}
-		return txn.Set([]byte(fmt.Sprintf("push_%s:%s", topic, msg.original.UUID)), data)
-	})
+	err := self.validate(topic, msg)
+	if err != nil {
+		return err
+	}
+	pending, err := self.outbox.Add(topic, msg.original)
 	if err != nil {
 		return err
 	}
 	return self.pushBuffer.Push(&PushItem{
+		seq:   pending.Seq,
 		topic: topic,
 		msg:   msg,
 	})
@@ -131,6 +153,18 @@ func (self *Hub) Sub(topic string, handler Handler) error {
 	go func() {
 		for msg := range messages {
 			wrapperMsg := &Message{original: msg}
+			err := self.validate(topic, wrapperMsg)
+			if err != nil {
+				log.WithError(err).Warnw("sub message invalid, route to dead letter", "topic", topic)
+				err = self.deadLetter(topic, wrapperMsg, err)
+				if err != nil {
+					log.WithError(err).Errorw("publish dead letter message error", "topic", topic)
+					msg.Nack()
+				} else {
+					msg.Ack()
+				}
+				continue
+			}
 			for _, middleware := range self.middlewares {
 				err = middleware(wrapperMsg)
 				if err != nil {
@@ -156,6 +190,10 @@ func (self *Hub) init() error {
 	if err != nil {
 		return err
 	}
+	self.outbox, err = NewOutbox(self.db)
+	if err != nil {
+		return err
+	}
 	err = self.loadUnFinishPush(true)
 	if err != nil {
 		return err
@@ -172,35 +210,14 @@ func (self *Hub) loadUnFinishPush(enable bool) error {
 	if !enable {
 		return nil
 	}
-	prefix := []byte("push_")
-	items := []*PushItem{}
-	err := self.db.View(func(tx *badger.Txn) error {
-		it := tx.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().Key()
-			key = key[5:]
-			topicAndUid := strings.Split(string(key), ":")
-			msg := message.Message{}
-			value, err := it.Item().ValueCopy(nil)
-			if err != nil {
-				return err
-			}
-			err = json.Unmarshal(value, &msg)
-			if err != nil {
-				return err
-			}
-			items = append(items, &PushItem{
-				topic: topicAndUid[0],
-				msg:   &Message{original: &msg},
-			})
-		}
-		return nil
-	})
-
+	pendings, err := self.outbox.List("")
 	if err != nil {
 		return err
 	}
+	items := make([]*PushItem, 0, len(pendings))
+	for _, pending := range pendings {
+		items = append(items, pending.pushItem())
+	}
 	return self.pushBuffer.Push(items...)
 }
 
@@ -214,18 +231,17 @@ func (self *Hub) runAsyncPub() {
 				return
 			}
 		}
-		err = self.Pub(item.topic, item.msg)
+		err = self.publish(item.topic, item.msg)
 		if err != nil {
 			log.WithError(err).Errorw("push message error", "topic", item.topic)
 			time.Sleep(time.Second)
 			continue
 		} else {
-			err = self.db.Update(func(txn *badger.Txn) error {
-				return txn.Delete([]byte(fmt.Sprintf("push_%s:%s", item.topic, item.msg.original.UUID)))
-			})
+			err = self.outbox.Delete(item.seq, item.topic, item.msg.UUID())
 			if err != nil {
 				log.WithError(err).Errorw("delete async push message error", "topic", item.topic)
 			}
+			self.pushBuffer.Done(item)
 			item = nil
 		}
 	}
@@ -235,7 +251,7 @@ func (self *Hub) Stop() error {
 	self.subscriber.Close()
 	self.publisher.Close()
 	self.pushBuffer.Close()
-	return nil
+	return self.outbox.Close()
 }
 
 func (self *Hub) createSubscriber() (message.Subscriber, error) {
@@ -341,11 +357,55 @@ func (self *Buffer) Pop() (*PushItem, error) {
 
 	item := self.items[0]
 	self.items = self.items[1:]
+	if self.inflight == nil {
+		self.inflight = map[uint64]bool{}
+	}
+	self.inflight[item.seq] = true
 	self.cond.Broadcast()
 
 	return item, nil
 }
 
+// Done marks the popped item as published, until then it is in flight and
+// left alone by Take.
+func (self *Buffer) Done(item *PushItem) {
+	self.cond.L.Lock()
+	defer self.cond.L.Unlock()
+
+	delete(self.inflight, item.seq)
+}
+
+// Take drops the buffered items with the seqs and returns them, with the seqs
+// which are not in flight.
+func (self *Buffer) Take(seqs []uint64) ([]*PushItem, []uint64) {
+	self.cond.L.Lock()
+	defer self.cond.L.Unlock()
+
+	idle := make([]uint64, 0, len(seqs))
+	for _, seq := range seqs {
+		if !self.inflight[seq] {
+			idle = append(idle, seq)
+		}
+	}
+	taken := []*PushItem{}
+	items := self.items[:0]
+	for _, item := range self.items {
+		if containsSeq(seqs, item.seq) {
+			taken = append(taken, item)
+		} else {
+			items = append(items, item)
+		}
+	}
+	for i := len(items); i < len(self.items); i++ {
+		self.items[i] = nil
+	}
+	self.items = items
+	if len(taken) > 0 {
+		self.cond.Broadcast()
+	}
+	return taken, idle
+}
+
 func (self *Buffer) PopN(size int) ([]*PushItem, error) {
 	self.cond.L.Lock()
 	defer self.cond.L.Unlock()
@@ -45,7 +45,9 @@ func TestEvent(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = hub.AsyncPub(topic, NewMessage([]byte("data")))
+	msg := NewMessage()
+	msg.SetPayloadData([]byte("data"))
+	err = hub.AsyncPub(topic, msg)
 	if err != nil {
 		t.Fatal(err)
 	}
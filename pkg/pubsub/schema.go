@@ -0,0 +1,124 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+
+	"go.yym.plus/zeus/pkg/utils/structs"
+)
+
+const (
+	MetaValidationError = "validation_error"
+	MetaOriginalTopic   = "original_topic"
+)
+
+// Schema validates the payload of messages published to or received from a topic.
+type Schema interface {
+	Validate(payload []byte) error
+}
+
+type JSONSchema struct {
+	schema *gojsonschema.Schema
+}
+
+type StructSchema struct {
+	typ reflect.Type
+}
+
+// NewJSONSchema returns a Schema backed by a JSON Schema document.
+func NewJSONSchema(schema []byte) (*JSONSchema, error) {
+	s, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+	if err != nil {
+		return nil, errors.WithMessage(err, "parse json schema error")
+	}
+	return &JSONSchema{schema: s}, nil
+}
+
+// NewStructSchema returns a Schema which decodes payloads into a new value of
+// the prototype's type and checks it with its validate tags.
+func NewStructSchema(prototype interface{}) *StructSchema {
+	typ := reflect.TypeOf(prototype)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return &StructSchema{typ: typ}
+}
+
+func (self *JSONSchema) Validate(payload []byte) error {
+	result, err := self.schema.Validate(gojsonschema.NewBytesLoader(payload))
+	if err != nil {
+		return errors.WithMessage(err, "payload is not valid json")
+	}
+	if result.Valid() {
+		return nil
+	}
+	msgs := make([]string, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		msgs = append(msgs, e.String())
+	}
+	return fmt.Errorf("payload invalid: %s", strings.Join(msgs, "; "))
+}
+
+func (self *StructSchema) Validate(payload []byte) error {
+	value := reflect.New(self.typ).Interface()
+	err := json.Unmarshal(payload, value)
+	if err != nil {
+		return errors.WithMessage(err, "payload is not valid json")
+	}
+	if self.typ.Kind() != reflect.Struct {
+		return nil
+	}
+	err = structs.Validate(value)
+	if err != nil {
+		return errors.WithMessage(err, "payload invalid")
+	}
+	return nil
+}
+
+// RegisterSchema binds a schema to the topic, messages of the topic are validated
+// on Pub/AsyncPub and on receipt.
+func (self *Hub) RegisterSchema(topic string, schema Schema) {
+	self.schemaLock.Lock()
+	defer self.schemaLock.Unlock()
+	if schema == nil {
+		delete(self.schemas, topic)
+		return
+	}
+	self.schemas[topic] = schema
+}
+
+func (self *Hub) Schema(topic string) Schema {
+	self.schemaLock.RLock()
+	defer self.schemaLock.RUnlock()
+	return self.schemas[topic]
+}
+
+func (self *Hub) validate(topic string, msg *Message) error {
+	schema := self.Schema(topic)
+	if schema == nil {
+		return nil
+	}
+	err := schema.Validate(msg.Payload())
+	if err != nil {
+		return errors.WithMessagef(err, "topic %s message %s", topic, msg.UUID())
+	}
+	return nil
+}
+
+func (self *Hub) deadLetterTopic(topic string) string {
+	return topic + "_" + self.conf.DeadLetterSuffix
+}
+
+// deadLetter publishes an invalid inbound message to the dead-letter topic of
+// the topic with the validation error attached as metadata.
+func (self *Hub) deadLetter(topic string, msg *Message, cause error) error {
+	dead := msg.original.Copy()
+	dead.Metadata.Set(MetaValidationError, cause.Error())
+	dead.Metadata.Set(MetaOriginalTopic, topic)
+	return self.publisher.Publish(self.conf.TopicPrefix+"_"+self.deadLetterTopic(topic), dead)
+}
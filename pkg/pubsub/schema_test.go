@@ -0,0 +1,59 @@
+package pubsub
+
+import (
+	"testing"
+)
+
+type orderCreated struct {
+	OrderID string `json:"orderID" validate:"required"`
+	Amount  int    `json:"amount" validate:"gt=0"`
+}
+
+func TestStructSchema(t *testing.T) {
+	schema := NewStructSchema(&orderCreated{})
+	if err := schema.Validate([]byte(`{"orderID":"a1","amount":10}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Validate([]byte(`{"orderID":"","amount":10}`)); err == nil {
+		t.Fatal("expect orderID required error")
+	}
+	if err := schema.Validate([]byte(`not json`)); err == nil {
+		t.Fatal("expect json error")
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	schema, err := NewJSONSchema([]byte(`{
+		"type": "object",
+		"properties": {"orderID": {"type": "string"}},
+		"required": ["orderID"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Validate([]byte(`{"orderID":"a1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.Validate([]byte(`{"amount":1}`)); err == nil {
+		t.Fatal("expect orderID required error")
+	}
+}
+
+func TestHubValidate(t *testing.T) {
+	hub := &Hub{conf: &Config{}, schemas: map[string]Schema{}}
+	hub.RegisterSchema("order", NewStructSchema(orderCreated{}))
+
+	msg := NewMessage()
+	if err := msg.SetPayload(orderCreated{OrderID: "a1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.validate("order", msg); err == nil {
+		t.Fatal("expect amount error")
+	}
+	if err := hub.validate("other", msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.AsyncPub("order", msg); err == nil {
+		t.Fatal("expect AsyncPub rejects invalid message")
+	}
+}